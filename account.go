@@ -0,0 +1,204 @@
+package wampshell
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	defaultShell = "/bin/sh"
+	// defaultPath and defaultRootPath are the PATH commands start with, a login
+	// shell usually extends it from the profile.
+	defaultPath     = "/usr/local/bin:/usr/bin:/bin"
+	defaultRootPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+)
+
+// Account is the local Unix user a remote session runs as.
+type Account struct {
+	Username string
+	UID      uint32
+	GID      uint32
+	Groups   []uint32
+	HomeDir  string
+	Shell    string
+}
+
+func CurrentAccount() (*Account, error) {
+	current, err := user.Current()
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up current user: %w", err)
+	}
+
+	return newAccount(current)
+}
+
+func LookupAccount(username string) (*Account, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up user %s: %w", username, err)
+	}
+
+	return newAccount(u)
+}
+
+func newAccount(u *user.User) (*Account, error) {
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid uid %s: %w", u.Uid, err)
+	}
+
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gid %s: %w", u.Gid, err)
+	}
+
+	groupIDs, err := u.GroupIds()
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up groups of %s: %w", u.Username, err)
+	}
+
+	groups := make([]uint32, 0, len(groupIDs))
+	for _, groupID := range groupIDs {
+		group, err := strconv.ParseUint(groupID, 10, 32)
+		if err != nil {
+			continue
+		}
+		groups = append(groups, uint32(group))
+	}
+
+	return &Account{
+		Username: u.Username,
+		UID:      uint32(uid),
+		GID:      uint32(gid),
+		Groups:   groups,
+		HomeDir:  u.HomeDir,
+		Shell:    lookupShell(u.Username),
+	}, nil
+}
+
+// lookupShell reads the login shell from /etc/passwd, os/user does not expose it.
+func lookupShell(username string) string {
+	file, err := os.Open("/etc/passwd")
+	if err != nil {
+		return defaultShell
+	}
+	defer func() { _ = file.Close() }()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) == 7 && fields[0] == username && fields[6] != "" {
+			return fields[6]
+		}
+	}
+
+	return defaultShell
+}
+
+// switchRequired reports whether acting as the account needs different credentials
+// than the ones the daemon runs with.
+func (a *Account) switchRequired() bool {
+	return uint32(os.Geteuid()) != a.UID //nolint:gosec
+}
+
+// Command prepares cmd to run as the account, in its home directory and with a
+// minimal environment of its own. The environment of wshd, which may be the one of
+// root, systemd or a snap, is not passed on.
+func (a *Account) Command(name string, args ...string) *exec.Cmd {
+	path := defaultPath
+	if a.UID == 0 {
+		path = defaultRootPath
+	}
+
+	cmd := exec.Command(name, args...)
+	cmd.Dir = a.HomeDir
+	cmd.Env = []string{
+		"PATH=" + path,
+		"HOME=" + a.HomeDir,
+		"USER=" + a.Username,
+		"LOGNAME=" + a.Username,
+		"SHELL=" + a.Shell,
+	}
+
+	if a.switchRequired() {
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Credential: &syscall.Credential{Uid: a.UID, Gid: a.GID, Groups: a.Groups},
+		}
+	}
+
+	return cmd
+}
+
+// SetTerm adds the terminal type of the client to the environment of cmd, unless it
+// is not a plausible terminal name.
+func SetTerm(cmd *exec.Cmd, term string) {
+	if term == "" || len(term) > 64 {
+		return
+	}
+	for _, c := range term {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-+._", c)) {
+			return
+		}
+	}
+
+	cmd.Env = append(cmd.Env, "TERM="+term)
+}
+
+// LoginShell prepares the account's shell to run as a login shell.
+func (a *Account) LoginShell() *exec.Cmd {
+	cmd := a.Command(a.Shell)
+	cmd.Args[0] = "-" + filepath.Base(a.Shell)
+	return cmd
+}
+
+// Path resolves path relative to the account's home directory.
+func (a *Account) Path(path string) string {
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path)
+	}
+
+	return filepath.Join(a.HomeDir, path)
+}
+
+func (a *Account) AuthorizedKeysPath() string {
+	return filepath.Join(a.HomeDir, ".wampshell", "authorized_keys")
+}
+
+// AuthorizeAccount maps an authenticated public key to the local account it may act
+// as and the restrictions that apply to it. A daemon that is not running as root can
+// only act as its own user, so the requested username is ignored and the key must be
+// in the daemon's key store, the same applies when no username or the daemon's own
+// account is requested. Other accounts need the key to be listed in that user's own
+// authorized_keys file.
+func AuthorizeAccount(keyStore *KeyStore, username, publicKey string) (*Account, *KeyOptions, error) {
+	current, err := CurrentAccount()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if username == "" || username == current.Username || os.Geteuid() != 0 {
+		if !keyStore.HasPublicKey(publicKey) {
+			return nil, nil, fmt.Errorf("key not authorized for user %s", current.Username)
+		}
+		return current, keyStore.Options(publicKey), nil
+	}
+
+	account, err := LookupAccount(username)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	options, ok := userKeyOptions(account.AuthorizedKeysPath(), publicKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("key not authorized for user %s", username)
+	}
+
+	return account, options, nil
+}
@@ -0,0 +1,72 @@
+package wampshell
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// Do runs fn with the filesystem credentials of the account. syscall.Setuid and
+// friends change the credentials of every thread in the process, so the per-thread
+// setfsuid, setfsgid and setgroups system calls are issued directly on a locked
+// thread instead. fn must not start goroutines that access the filesystem.
+func (a *Account) Do(fn func() error) error {
+	if !a.switchRequired() {
+		return fn()
+	}
+
+	groups, err := syscall.Getgroups()
+	if err != nil {
+		return fmt.Errorf("failed to get groups: %w", err)
+	}
+
+	runtime.LockOSThread()
+	if err = setThreadCredentials(a.UID, a.GID, a.Groups); err != nil {
+		// the thread may be left with partially changed credentials, returning while
+		// still locked makes the runtime discard it once the goroutine exits
+		return err
+	}
+
+	defer func() {
+		originalGroups := make([]uint32, 0, len(groups))
+		for _, group := range groups {
+			originalGroups = append(originalGroups, uint32(group)) //nolint:gosec
+		}
+
+		uid, gid := uint32(syscall.Geteuid()), uint32(syscall.Getegid()) //nolint:gosec
+		if setThreadCredentials(uid, gid, originalGroups) == nil {
+			runtime.UnlockOSThread()
+		}
+	}()
+
+	return fn()
+}
+
+func setThreadCredentials(uid, gid uint32, groups []uint32) error {
+	var groupsPtr unsafe.Pointer
+	if len(groups) > 0 {
+		groupsPtr = unsafe.Pointer(&groups[0])
+	}
+
+	_, _, errno := syscall.RawSyscall(sysSetgroups, uintptr(len(groups)), uintptr(groupsPtr), 0)
+	if errno != 0 {
+		return fmt.Errorf("setgroups failed: %w", errno)
+	}
+
+	// setfsgid and setfsuid always return the previous value, calling them twice
+	// is the documented way to check whether the change took effect
+	_, _, _ = syscall.RawSyscall(sysSetfsgid, uintptr(gid), 0, 0)
+	current, _, _ := syscall.RawSyscall(sysSetfsgid, uintptr(gid), 0, 0)
+	if uint32(current) != gid {
+		return fmt.Errorf("setfsgid %d failed", gid)
+	}
+
+	_, _, _ = syscall.RawSyscall(sysSetfsuid, uintptr(uid), 0, 0)
+	current, _, _ = syscall.RawSyscall(sysSetfsuid, uintptr(uid), 0, 0)
+	if uint32(current) != uid {
+		return fmt.Errorf("setfsuid %d failed", uid)
+	}
+
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build linux && (386 || arm)
+
+package wampshell
+
+import "syscall"
+
+// The original system calls take 16 bit ids on these architectures, their 32 bit
+// variants have a suffix.
+const (
+	sysSetgroups = syscall.SYS_SETGROUPS32
+	sysSetfsuid  = syscall.SYS_SETFSUID32
+	sysSetfsgid  = syscall.SYS_SETFSGID32
+)
@@ -0,0 +1,11 @@
+//go:build linux && !(386 || arm)
+
+package wampshell
+
+import "syscall"
+
+const (
+	sysSetgroups = syscall.SYS_SETGROUPS
+	sysSetfsuid  = syscall.SYS_SETFSUID
+	sysSetfsgid  = syscall.SYS_SETFSGID
+)
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package wampshell
+
+import "fmt"
+
+// Do runs fn with the filesystem credentials of the account. Per-thread
+// credentials are only available on Linux, elsewhere the daemon can act as
+// its own user only.
+func (a *Account) Do(fn func() error) error {
+	if a.switchRequired() {
+		return fmt.Errorf("acting as user %s is not supported on this platform", a.Username)
+	}
+
+	return fn()
+}
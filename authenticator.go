@@ -2,6 +2,7 @@ package wampshell
 
 import (
 	"fmt"
+	"os"
 
 	"github.com/xconnio/wampproto-go/auth"
 )
@@ -28,6 +29,19 @@ func (a *ServerAuthenticator) Authenticate(request auth.Request) (auth.Response,
 		return auth.NewResponse("", "anonymous", 0)
 	}
 
+	// when running as root, users may authorize keys for their own account, the
+	// key exchange later checks that the session really acts as that account
+	username, _ := cryptosignRequest.AuthExtra()["user"].(string)
+	if username != "" && os.Geteuid() == 0 {
+		account, err := LookupAccount(username)
+		if err != nil {
+			return nil, fmt.Errorf("unauthorized")
+		}
+		if _, ok := userKeyOptions(account.AuthorizedKeysPath(), cryptosignRequest.PublicKey()); ok {
+			return auth.NewResponse("", "anonymous", 0)
+		}
+	}
+
 	return nil, fmt.Errorf("unauthorized")
 }
 
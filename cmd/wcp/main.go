@@ -4,114 +4,204 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 
 	"github.com/jessevdk/go-flags"
 
-	"github.com/xconnio/berncrypt/go"
-	"github.com/xconnio/wampproto-go/auth"
 	"github.com/xconnio/wampshell"
-	"github.com/xconnio/xconn-go"
 )
 
-const (
-	maxSize = 1024 * 1024 * 15
-)
+func parseRemoteTarget(target string) (user, host, port, path string, err error) {
+	port = "8022"
 
-func uploadFile(session *xconn.Session, keys *wampshell.KeyPair, localPath, remotePath string) error {
-	fileInfo, err := os.Stat(localPath)
-	if err != nil {
-		return fmt.Errorf("failed to stat local file: %w", err)
+	if strings.Contains(target, "@") {
+		parts := strings.SplitN(target, "@", 2)
+		user, target = parts[0], parts[1]
 	}
-	if fileInfo.Size() > maxSize {
-		return fmt.Errorf("file too large: %d bytes (max %d bytes)", fileInfo.Size(), maxSize)
+
+	parts := strings.SplitN(target, ":", 3)
+	switch len(parts) {
+	case 2:
+		host, path = parts[0], parts[1]
+	case 3:
+		host, port, path = parts[0], parts[1], parts[2]
+	default:
+		err = fmt.Errorf("invalid target: %s", target)
 	}
 
-	data, err := os.ReadFile(localPath)
-	if err != nil {
-		return fmt.Errorf("failed to read local file: %w", err)
+	if user == "" {
+		user = os.Getenv("USER")
 	}
+	return
+}
 
-	ciphertext, nonce, err := berncrypt.EncryptChaCha20Poly1305(data, keys.Send)
-	if err != nil {
-		return err
+type Options struct {
+	Recursive             bool `short:"r" long:"recursive" description:"Copy directories recursively"`
+	Preserve              bool `short:"p" long:"preserve" description:"Preserve modes, access and modification times"`
+	PreserveOwner         bool `long:"preserve-owner" description:"Preserve numeric owner and group, implies -p"`
+	Resume                bool `long:"resume" description:"Continue partially transferred files"`
+	Sync                  bool `long:"sync" description:"Only transfer the changed parts of a tree, implies -r and -p"`
+	Delete                bool `long:"delete" description:"With --sync, delete files that do not exist in the source"`
+	DryRun                bool `short:"n" long:"dry-run" description:"With --sync, only show what would be changed"`
+	Quiet                 bool `short:"q" long:"quiet" description:"Do not show progress or per-file messages"`
+	Summary               bool `long:"summary" description:"Print a JSON summary line to stdout when done"`
+	StrictHostKeyChecking bool `long:"strict-host-key-checking" description:"Refuse to connect to unknown hosts"`
+	Args                  struct {
+		Paths []string `positional-arg-name:"source... target" required:"2"`
+	} `positional-args:"yes"`
+}
+
+// syncOptions prints the changes of a dry run to stdout. Otherwise the transferred
+// files are shown by the reporter and only deletions are logged.
+func syncOptions(opts *Options, transfer *wampshell.TransferOptions) *wampshell.SyncOptions {
+	return &wampshell.SyncOptions{
+		TransferOptions: *transfer,
+		Delete:          opts.Delete,
+		DryRun:          opts.DryRun,
+		Report: func(action, name string) {
+			switch {
+			case opts.DryRun:
+				fmt.Printf("%s %s\n", action, name)
+			case action == wampshell.SyncDelete && !opts.Quiet:
+				log.Printf("Deleted %s", name)
+			}
+		},
 	}
+}
 
-	encryptedPayload := append(nonce, ciphertext...)
-	callResponse := session.Call("wampshell.shell.upload").Args(remotePath, encryptedPayload).Do()
-	if callResponse.Err != nil {
-		return fmt.Errorf("file upload error: %w", callResponse.Err)
+// endpoint is a source or the target of a copy, it is remote if client is set.
+type endpoint struct {
+	client *wampshell.FileClient
+	path   string
+}
+
+func (e *endpoint) base() string {
+	if e.client != nil {
+		return path.Base(e.path)
 	}
 
-	encResp, err := callResponse.Args.Bytes(0)
-	if err != nil {
-		return fmt.Errorf("parsing response failed: %w", err)
+	return filepath.Base(e.path)
+}
+
+func (e *endpoint) join(name string) string {
+	if e.client != nil {
+		return path.Join(e.path, name)
 	}
 
-	plainResp, err := berncrypt.DecryptChaCha20Poly1305(encResp[12:], encResp[:12], keys.Receive)
-	if err != nil {
-		return fmt.Errorf("response decryption failed: %w", err)
+	return filepath.Join(e.path, name)
+}
+
+// isDir reports whether e is an existing directory. Remote paths ending in a slash
+// and the empty path, which is the remote home directory, are always directories.
+func (e *endpoint) isDir() bool {
+	if e.client == nil {
+		info, err := os.Stat(e.path)
+		return err == nil && info.IsDir()
 	}
 
-	log.Printf("Upload response: %s", string(plainResp))
-	return nil
+	if e.path == "" || strings.HasSuffix(e.path, "/") {
+		return true
+	}
+
+	entry, err := e.client.Stat(e.path)
+	return err == nil && entry.Type == wampshell.FileTypeDir
+}
+
+// connector opens one session per remote user and host.
+type connector struct {
+	strictHostKeyChecking bool
+	clients               map[string]*wampshell.FileClient
 }
 
-func downloadFile(session *xconn.Session, keys *wampshell.KeyPair, remotePath, localPath string) error {
-	callResponse := session.Call("wampshell.shell.download").Arg(remotePath).Do()
-	if callResponse.Err != nil {
-		return fmt.Errorf("file download error: %w", callResponse.Err)
+func newConnector(strictHostKeyChecking bool) *connector {
+	return &connector{
+		strictHostKeyChecking: strictHostKeyChecking,
+		clients:               make(map[string]*wampshell.FileClient),
 	}
+}
 
-	encResp, err := callResponse.Args.Bytes(0)
-	if err != nil {
-		return fmt.Errorf("failed to parse response: %w", err)
+func (c *connector) endpoint(arg string) (*endpoint, error) {
+	if !strings.Contains(arg, ":") {
+		return &endpoint{path: arg}, nil
 	}
 
-	data, err := berncrypt.DecryptChaCha20Poly1305(encResp[12:], encResp[:12], keys.Receive)
+	user, host, port, remotePath, err := parseRemoteTarget(arg)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if err := os.WriteFile(localPath, data, 0600); err != nil {
-		return fmt.Errorf("failed to save file: %w", err)
+	key := user + "@" + net.JoinHostPort(host, port)
+	client, ok := c.clients[key]
+	if !ok {
+		session, keys, err := wampshell.Connect(context.Background(), host, port, user, c.strictHostKeyChecking)
+		if err != nil {
+			return nil, err
+		}
+		client = wampshell.NewFileClient(session, keys)
+		c.clients[key] = client
 	}
 
-	log.Printf("Downloaded %s → %s (%d bytes)", remotePath, localPath, len(data))
-	return nil
+	return &endpoint{client: client, path: remotePath}, nil
 }
 
-func parseRemoteTarget(target string) (user, host, port, path string, err error) {
-	port = "8022"
-
-	if strings.Contains(target, "@") {
-		parts := strings.SplitN(target, "@", 2)
-		user, target = parts[0], parts[1]
+// expand replaces a remote source that contains glob characters by the paths matching
+// it on the remote host, local patterns are already expanded by the shell.
+func expand(source *endpoint) ([]*endpoint, error) {
+	if source.client == nil || !strings.ContainsAny(source.path, "*?[") {
+		return []*endpoint{source}, nil
 	}
 
-	parts := strings.SplitN(target, ":", 3)
-	switch len(parts) {
-	case 2:
-		host, path = parts[0], parts[1]
-	case 3:
-		host, port, path = parts[0], parts[1], parts[2]
-	default:
-		err = fmt.Errorf("invalid target: %s", target)
+	matches, err := source.client.Glob(source.path)
+	if err != nil {
+		return nil, err
 	}
 
-	if user == "" {
-		user = os.Getenv("USER")
+	endpoints := make([]*endpoint, 0, len(matches))
+	for _, match := range matches {
+		endpoints = append(endpoints, &endpoint{client: source.client, path: match})
 	}
-	return
+
+	return endpoints, nil
 }
 
-type Options struct {
-	Args struct {
-		Source string `positional-arg-name:"source" required:"true"`
-		Target string `positional-arg-name:"target" required:"true"`
-	} `positional-args:"yes"`
+// copyTo copies source to target, or into it if intoDir is set.
+func copyTo(opts *Options, transfer *wampshell.TransferOptions, source, target *endpoint, intoDir bool) error {
+	dst := target.path
+	if intoDir {
+		dst = target.join(source.base())
+	}
+
+	switch {
+	case source.client == nil:
+		switch {
+		case opts.Sync:
+			return target.client.SyncUp(source.path, dst, syncOptions(opts, transfer))
+		case opts.Recursive:
+			return target.client.UploadTree(source.path, dst, transfer)
+		default:
+			return target.client.Upload(source.path, dst, transfer)
+		}
+	case target.client == nil:
+		switch {
+		case opts.Sync:
+			return source.client.SyncDown(source.path, dst, syncOptions(opts, transfer))
+		case opts.Recursive:
+			return source.client.DownloadTree(source.path, dst, transfer)
+		default:
+			return source.client.Download(source.path, dst, transfer)
+		}
+	default:
+		// the data is relayed between two sessions, so both hosts only need to be
+		// reachable from here
+		if opts.Recursive {
+			return source.client.CopyTreeTo(source.path, target.client, dst, transfer)
+		}
+		return source.client.CopyTo(source.path, target.client, dst, transfer)
+	}
 }
 
 func main() {
@@ -122,67 +212,73 @@ func main() {
 		log.Fatal(err)
 	}
 
-	src := opts.Args.Source
-	dst := opts.Args.Target
-
-	var mode string
-	var localPath, remotePath string
-	var user, host, port string
-
-	if strings.Contains(src, ":") && !strings.Contains(dst, ":") {
-		mode = "download"
-		user, host, port, remotePath, _ = parseRemoteTarget(src)
-		localPath = dst
-	} else if !strings.Contains(src, ":") && strings.Contains(dst, ":") {
-		mode = "upload"
-		localPath = src
-		user, host, port, remotePath, _ = parseRemoteTarget(dst)
-	} else {
-		log.Fatal("Invalid usage: one of source/target must be remote (user@host:path)")
+	if (opts.Delete || opts.DryRun) && !opts.Sync {
+		log.Fatal("Invalid usage: --delete and --dry-run require --sync")
 	}
 
-	privateKey, err := wampshell.ReadPrivateKeyFromFile()
-	if err != nil {
-		log.Fatalf("Reading private key failed: %v", err)
+	args := opts.Args.Paths
+	targetArg := args[len(args)-1]
+	for _, arg := range args[:len(args)-1] {
+		switch {
+		case !strings.Contains(arg, ":") && !strings.Contains(targetArg, ":"):
+			log.Fatal("Invalid usage: source or target must be remote (user@host:path)")
+		case strings.Contains(arg, ":") && strings.Contains(targetArg, ":") && opts.Sync:
+			log.Fatal("Invalid usage: --sync requires a local source or target")
+		}
 	}
 
-	authenticator, err := auth.NewCryptoSignAuthenticator("", privateKey, map[string]any{"user": user})
+	// the target has its own sessions, relaying data between two paths on the same
+	// host must not wait for itself on a single session
+	target, err := newConnector(opts.StrictHostKeyChecking).endpoint(targetArg)
 	if err != nil {
-		log.Fatalf("Creating authenticator failed: %v", err)
+		log.Fatal(err)
 	}
 
-	client := xconn.Client{
-		SerializerSpec: wampshell.CapnprotoSerializerSpec,
-		Authenticator:  authenticator,
+	sourceConnector := newConnector(opts.StrictHostKeyChecking)
+	var sources []*endpoint
+	for _, arg := range args[:len(args)-1] {
+		source, err := sourceConnector.endpoint(arg)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		expanded, err := expand(source)
+		if err != nil {
+			log.Fatalf("%s: %v", arg, err)
+		}
+		sources = append(sources, expanded...)
 	}
 
-	url := fmt.Sprintf("rs://%s:%s", host, port)
-	session, err := client.Connect(context.Background(), url, "wampshell")
-	if err != nil {
-		log.Fatalf("Connection failed: %v", err)
+	intoDir := target.isDir()
+	if len(sources) > 1 && !intoDir {
+		log.Fatalf("Target %s is not a directory", targetArg)
 	}
 
-	keys, err := wampshell.ExchangeKeys(session)
-	if err != nil {
-		log.Fatalf("Key exchange failed: %v", err)
+	reporter := newReporter(opts.Quiet)
+	transfer := &wampshell.TransferOptions{
+		Preserve:      opts.Preserve || opts.PreserveOwner,
+		PreserveOwner: opts.PreserveOwner,
+		Resume:        opts.Resume,
+		Progress:      reporter,
 	}
 
-	switch mode {
-	case "upload":
-		if strings.HasSuffix(remotePath, "/") {
-			remotePath += filepath.Base(localPath)
-		} else if remotePath == "" {
-			remotePath = filepath.Base(localPath)
-		}
-		if err := uploadFile(session, keys, localPath, remotePath); err != nil {
-			log.Fatalf("Upload failed: %v", err)
+	// like scp, a failed source does not stop the remaining ones
+	failed := false
+	for _, source := range sources {
+		if err = copyTo(&opts, transfer, source, target, intoDir); err != nil {
+			reporter.abort()
+			log.Printf("Copying %s failed: %v", source.path, err)
+			failed = true
 		}
-	case "download":
-		if fi, err := os.Stat(localPath); err == nil && fi.IsDir() {
-			localPath = filepath.Join(localPath, filepath.Base(remotePath))
-		}
-		if err := downloadFile(session, keys, remotePath, localPath); err != nil {
-			log.Fatalf("Download failed: %v", err)
+	}
+
+	if opts.Summary {
+		if err = reporter.writeSummary(os.Stdout); err != nil {
+			log.Fatalf("Writing summary failed: %v", err)
 		}
 	}
+
+	if failed {
+		os.Exit(1)
+	}
 }
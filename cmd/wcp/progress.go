@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/term"
+
+	"github.com/xconnio/wampshell"
+)
+
+const progressInterval = 200 * time.Millisecond
+
+// reporter shows the progress of the transfers and accumulates the totals for the
+// summary. The progress bar is only drawn when stderr is a terminal, otherwise one
+// line is logged per completed file.
+type reporter struct {
+	out         io.Writer
+	interactive bool
+	quiet       bool
+
+	started time.Time
+	files   int
+	bytes   int64
+
+	transfer  *wampshell.Transfer
+	name      string
+	total     int64
+	offset    int64
+	done      int64
+	fileStart time.Time
+	drawn     time.Time
+	active    bool
+}
+
+func newReporter(quiet bool) *reporter {
+	return &reporter{
+		out:         os.Stderr,
+		interactive: !quiet && term.IsTerminal(int(os.Stderr.Fd())),
+		quiet:       quiet,
+		started:     time.Now(),
+	}
+}
+
+func (r *reporter) Start(transfer *wampshell.Transfer) {
+	r.transfer = transfer
+	r.name = filepath.Base(transfer.Source)
+	r.total = transfer.Size
+	r.offset = transfer.Offset
+	r.done = transfer.Offset
+	r.fileStart = time.Now()
+	r.drawn = time.Time{}
+	r.active = true
+	r.draw(false)
+}
+
+func (r *reporter) Add(n int) {
+	r.done += int64(n)
+	r.draw(false)
+}
+
+// Finish completes the current file, which is logged instead of the progress bar
+// when stderr is not a terminal.
+func (r *reporter) Finish() {
+	r.files++
+	r.bytes += r.done - r.offset
+	r.active = false
+
+	if r.interactive {
+		r.total = r.done
+		r.draw(true)
+		_, _ = fmt.Fprintln(r.out)
+	} else if !r.quiet {
+		verb := "Downloaded"
+		if r.transfer.Upload {
+			verb = "Uploaded"
+		}
+		log.Printf("%s %s → %s (%d bytes)", verb, r.transfer.Source, r.transfer.Destination, r.done)
+	}
+}
+
+// abort ends the progress bar of a failed file so that the error starts on its own line.
+func (r *reporter) abort() {
+	if r.interactive && r.active {
+		_, _ = fmt.Fprintln(r.out)
+	}
+	r.active = false
+}
+
+func (r *reporter) draw(force bool) {
+	if !r.interactive {
+		return
+	}
+
+	now := time.Now()
+	if !force && now.Sub(r.drawn) < progressInterval {
+		return
+	}
+	r.drawn = now
+
+	elapsed := now.Sub(r.fileStart).Seconds()
+	var rate float64
+	if elapsed > 0 {
+		rate = float64(r.done-r.offset) / elapsed
+	}
+
+	percent, eta := "   ", "--:--"
+	if r.total > 0 {
+		percent = fmt.Sprintf("%3d%%", r.done*100/r.total)
+		if rate > 0 {
+			eta = formatDuration(time.Duration(float64(r.total-r.done) / rate * float64(time.Second)))
+		}
+	} else if r.total == 0 {
+		percent = "100%"
+	}
+
+	_, _ = fmt.Fprintf(r.out, "\r\033[K%-32s %s %10s %10s/s %s ETA", truncateName(r.name, 32), percent,
+		formatBytes(r.done), formatBytes(int64(rate)), eta)
+}
+
+// summary is the machine-readable result of a wcp run.
+type summary struct {
+	Files          int     `json:"files"`
+	Bytes          int64   `json:"bytes"`
+	Seconds        float64 `json:"seconds"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+}
+
+// writeSummary prints the totals of all transfers as a single JSON line.
+func (r *reporter) writeSummary(out io.Writer) error {
+	elapsed := time.Since(r.started).Seconds()
+	result := summary{Files: r.files, Bytes: r.bytes, Seconds: elapsed}
+	if elapsed > 0 {
+		result.BytesPerSecond = float64(r.bytes) / elapsed
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(out, string(data))
+	return err
+}
+
+func truncateName(name string, width int) string {
+	if len(name) <= width {
+		return name
+	}
+
+	return "..." + name[len(name)-width+3:]
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	hours := int(d / time.Hour)
+	minutes := int(d % time.Hour / time.Minute)
+	seconds := int(d % time.Minute / time.Second)
+	if hours > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", hours, minutes, seconds)
+	}
+
+	return fmt.Sprintf("%02d:%02d", minutes, seconds)
+}
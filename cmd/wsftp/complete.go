@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/xconnio/wampshell"
+)
+
+// candidate is a possible completion of the word being typed.
+type candidate struct {
+	name  string
+	isDir bool
+}
+
+// localArgument reports whether argument number index of cmd, counting from zero and
+// ignoring flags, is a local path.
+func localArgument(cmd string, index int) bool {
+	switch cmd {
+	case "lcd":
+		return true
+	case "put":
+		return index == 0
+	case "get":
+		return index == 1
+	default:
+		return false
+	}
+}
+
+// complete implements tab completion of command names and of remote and local paths.
+// Ambiguous completions that can not be extended any further are listed on out.
+func (s *sftpSession) complete(out io.Writer, line string, pos int) (string, int, bool) {
+	prefix := line[:pos]
+	fields := strings.Fields(prefix)
+
+	word := ""
+	if len(fields) > 0 && !strings.HasSuffix(prefix, " ") {
+		word = fields[len(fields)-1]
+		fields = fields[:len(fields)-1]
+	}
+
+	var candidates []candidate
+	dirPart := ""
+	if len(fields) == 0 {
+		for name := range s.commands {
+			candidates = append(candidates, candidate{name: name})
+		}
+	} else {
+		index := 0
+		for _, field := range fields[1:] {
+			if !strings.HasPrefix(field, "-") {
+				index++
+			}
+		}
+
+		var base string
+		if i := strings.LastIndex(word, "/"); i >= 0 {
+			dirPart, base = word[:i+1], word[i+1:]
+		} else {
+			base = word
+		}
+
+		var err error
+		if localArgument(fields[0], index) {
+			candidates, err = localCandidates(dirPart)
+		} else {
+			candidates, err = s.remoteCandidates(dirPart)
+		}
+		if err != nil {
+			return "", 0, false
+		}
+
+		// hidden files are only offered once the name starts with a dot
+		filtered := candidates[:0]
+		for _, c := range candidates {
+			if !strings.HasPrefix(c.name, ".") || strings.HasPrefix(base, ".") {
+				filtered = append(filtered, c)
+			}
+		}
+		candidates = filtered
+	}
+
+	var matches []candidate
+	for _, c := range candidates {
+		if strings.HasPrefix(c.name, strings.TrimPrefix(word, dirPart)) {
+			matches = append(matches, c)
+		}
+	}
+	if len(matches) == 0 {
+		return "", 0, false
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].name < matches[j].name })
+
+	var completion string
+	if len(matches) == 1 {
+		completion = dirPart + matches[0].name
+		if matches[0].isDir {
+			completion += "/"
+		} else {
+			completion += " "
+		}
+	} else {
+		common := matches[0].name
+		for _, m := range matches[1:] {
+			for !strings.HasPrefix(m.name, common) {
+				common = common[:len(common)-1]
+			}
+		}
+		completion = dirPart + common
+
+		if completion == word {
+			names := make([]string, 0, len(matches))
+			for _, m := range matches {
+				names = append(names, m.name)
+			}
+			_, _ = fmt.Fprintln(out, strings.Join(names, "  "))
+		}
+	}
+
+	start := len(prefix) - len(word)
+	return prefix[:start] + completion + line[pos:], start + len(completion), true
+}
+
+func (s *sftpSession) remoteCandidates(dir string) ([]candidate, error) {
+	entries, err := s.client.List(s.resolve(dir))
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := make([]candidate, 0, len(entries))
+	for _, entry := range entries {
+		candidates = append(candidates, candidate{name: entry.Path, isDir: entry.Type == wampshell.FileTypeDir})
+	}
+
+	return candidates, nil
+}
+
+func localCandidates(dir string) ([]candidate, error) {
+	if dir == "" {
+		dir = "."
+	}
+
+	entries, err := os.ReadDir(filepath.FromSlash(dir))
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := make([]candidate, 0, len(entries))
+	for _, entry := range entries {
+		candidates = append(candidates, candidate{name: entry.Name(), isDir: entry.IsDir()})
+	}
+
+	return candidates, nil
+}
@@ -0,0 +1,554 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jessevdk/go-flags"
+	"golang.org/x/term"
+
+	"github.com/xconnio/wampshell"
+)
+
+const prompt = "wsftp> "
+
+type command struct {
+	usage string
+	help  string
+	run   func(s *sftpSession, args []string) error
+}
+
+func newCommands() map[string]*command {
+	return map[string]*command{
+		"ls":     {"ls [-al] [path]", "List remote directory", (*sftpSession).ls},
+		"cd":     {"cd [path]", "Change remote directory, the home directory if no path is given", (*sftpSession).cd},
+		"pwd":    {"pwd", "Print remote working directory", (*sftpSession).pwd},
+		"lcd":    {"lcd [path]", "Change local directory", (*sftpSession).lcd},
+		"lpwd":   {"lpwd", "Print local working directory", (*sftpSession).lpwd},
+		"get":    {"get [-pr] remote [local]", "Download file or, with -r, directory", (*sftpSession).get},
+		"put":    {"put [-pr] local [remote]", "Upload file or, with -r, directory", (*sftpSession).put},
+		"mkdir":  {"mkdir path", "Create remote directory", (*sftpSession).mkdir},
+		"rm":     {"rm [-r] path", "Remove remote file, empty directory or, with -r, tree", (*sftpSession).rm},
+		"rename": {"rename old new", "Rename remote file", (*sftpSession).rename},
+		"chmod":  {"chmod mode path", "Change permissions of remote file", (*sftpSession).chmod},
+		"help":   {"help", "Show this help", (*sftpSession).help},
+		"exit":   {"exit", "Quit wsftp", nil},
+		"quit":   {"quit", "Quit wsftp", nil},
+		"bye":    {"bye", "Quit wsftp", nil},
+	}
+}
+
+var errQuit = errors.New("quit") //nolint:gochecknoglobals
+
+type sftpSession struct {
+	client   *wampshell.FileClient
+	commands map[string]*command
+	out      io.Writer
+	// cwd is the remote working directory, relative paths are relative to the home
+	// directory of the remote user, which is the empty path
+	cwd string
+}
+
+func (s *sftpSession) usage(name string) error {
+	return fmt.Errorf("usage: %s", s.commands[name].usage)
+}
+
+// resolve turns a path given by the user into one understood by wshd.
+func (s *sftpSession) resolve(p string) string {
+	switch {
+	case p == "" || p == ".":
+		return s.cwd
+	case p == "~":
+		return ""
+	case strings.HasPrefix(p, "~/"):
+		return path.Clean(p[2:])
+	case path.IsAbs(p) || s.cwd == "":
+		return path.Clean(p)
+	default:
+		return path.Join(s.cwd, p)
+	}
+}
+
+func displayPath(p string) string {
+	switch {
+	case p == "":
+		return "~"
+	case path.IsAbs(p):
+		return p
+	default:
+		return "~/" + p
+	}
+}
+
+// parseFlags splits leading single letter flags like -pr from the arguments.
+func parseFlags(args []string, allowed string) (map[rune]bool, []string, error) {
+	set := make(map[rune]bool)
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") && len(args[0]) > 1 {
+		for _, flag := range args[0][1:] {
+			if !strings.ContainsRune(allowed, flag) {
+				return nil, nil, fmt.Errorf("unknown flag -%c", flag)
+			}
+			set[flag] = true
+		}
+		args = args[1:]
+	}
+
+	return set, args, nil
+}
+
+func (s *sftpSession) ls(args []string) error {
+	flagSet, args, err := parseFlags(args, "al")
+	if err != nil {
+		return err
+	}
+	if len(args) > 1 {
+		return s.usage("ls")
+	}
+
+	target := ""
+	if len(args) == 1 {
+		target = args[0]
+	}
+
+	// like ls, a symlink to a directory lists the directory, any other path is
+	// described itself
+	var entries []wampshell.FileEntry
+	entry, err := s.client.StatFollow(s.resolve(target))
+	listing := err == nil && entry.Type == wampshell.FileTypeDir
+	if listing {
+		entries, err = s.client.List(s.resolve(target))
+	} else if entry, err = s.client.Stat(s.resolve(target)); err == nil {
+		entries = []wampshell.FileEntry{*entry}
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if listing && strings.HasPrefix(entry.Path, ".") && !flagSet['a'] {
+			continue
+		}
+
+		if !flagSet['l'] {
+			name := entry.Path
+			if entry.Type == wampshell.FileTypeDir {
+				name += "/"
+			}
+			_, _ = fmt.Fprintln(s.out, name)
+			continue
+		}
+
+		_, _ = fmt.Fprintln(s.out, longListing(&entry))
+	}
+
+	return nil
+}
+
+func longListing(entry *wampshell.FileEntry) string {
+	typ := "-"
+	switch entry.Type {
+	case wampshell.FileTypeDir:
+		typ = "d"
+	case wampshell.FileTypeSymlink:
+		typ = "l"
+	case wampshell.FileTypeOther:
+		typ = "?"
+	}
+
+	var mode, modTime string
+	if entry.Metadata != nil {
+		mode = entry.Metadata.Mode.Perm().String()[1:]
+		modTime = entry.Metadata.ModTime.Format("Jan _2 15:04 2006")
+	}
+
+	line := fmt.Sprintf("%s%s %12d %s %s", typ, mode, entry.Size, modTime, entry.Path)
+	if entry.Type == wampshell.FileTypeSymlink {
+		line += " -> " + entry.Target
+	}
+
+	return line
+}
+
+func (s *sftpSession) cd(args []string) error {
+	if len(args) > 1 {
+		return s.usage("cd")
+	}
+
+	target := "~"
+	if len(args) == 1 {
+		target = args[0]
+	}
+
+	dir := s.resolve(target)
+	entry, err := s.client.StatFollow(dir)
+	if err != nil {
+		return err
+	}
+	if entry.Type != wampshell.FileTypeDir {
+		return fmt.Errorf("%s is not a directory", displayPath(dir))
+	}
+
+	s.cwd = dir
+	return nil
+}
+
+func (s *sftpSession) pwd([]string) error {
+	_, err := fmt.Fprintf(s.out, "Remote working directory: %s\n", displayPath(s.cwd))
+	return err
+}
+
+func (s *sftpSession) lcd(args []string) error {
+	if len(args) > 1 {
+		return s.usage("lcd")
+	}
+
+	var dir string
+	if len(args) == 1 {
+		dir = args[0]
+	} else {
+		home, err := wampshell.RealHome()
+		if err != nil {
+			return err
+		}
+		dir = home
+	}
+
+	return os.Chdir(dir)
+}
+
+func (s *sftpSession) lpwd([]string) error {
+	dir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(s.out, "Local working directory: %s\n", dir)
+	return err
+}
+
+// transferOptions reports every transferred file like sftp does.
+func (s *sftpSession) transferOptions(flagSet map[rune]bool) *wampshell.TransferOptions {
+	return &wampshell.TransferOptions{
+		Preserve: flagSet['p'],
+		Progress: &announcer{out: s.out},
+	}
+}
+
+func (s *sftpSession) get(args []string) error {
+	flagSet, args, err := parseFlags(args, "pr")
+	if err != nil {
+		return err
+	}
+	if len(args) < 1 || len(args) > 2 {
+		return s.usage("get")
+	}
+
+	remotePath := s.resolve(args[0])
+	localPath := path.Base(remotePath)
+	if len(args) == 2 {
+		localPath = args[1]
+	}
+	if info, err := os.Stat(localPath); err == nil && info.IsDir() {
+		localPath = filepath.Join(localPath, path.Base(remotePath))
+	}
+
+	if flagSet['r'] {
+		return s.client.DownloadTree(remotePath, localPath, s.transferOptions(flagSet))
+	}
+
+	return s.client.Download(remotePath, localPath, s.transferOptions(flagSet))
+}
+
+func (s *sftpSession) put(args []string) error {
+	flagSet, args, err := parseFlags(args, "pr")
+	if err != nil {
+		return err
+	}
+	if len(args) < 1 || len(args) > 2 {
+		return s.usage("put")
+	}
+
+	localPath := args[0]
+	remotePath := s.resolve(filepath.Base(localPath))
+	if len(args) == 2 {
+		remotePath = s.resolve(args[1])
+		if entry, err := s.client.Stat(remotePath); err == nil && entry.Type == wampshell.FileTypeDir {
+			remotePath = path.Join(remotePath, filepath.Base(localPath))
+		}
+	}
+
+	if flagSet['r'] {
+		return s.client.UploadTree(localPath, remotePath, s.transferOptions(flagSet))
+	}
+
+	return s.client.Upload(localPath, remotePath, s.transferOptions(flagSet))
+}
+
+func (s *sftpSession) mkdir(args []string) error {
+	if len(args) != 1 {
+		return s.usage("mkdir")
+	}
+
+	return s.client.Mkdir(s.resolve(args[0]), 0755, false)
+}
+
+func (s *sftpSession) rm(args []string) error {
+	flagSet, args, err := parseFlags(args, "r")
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return s.usage("rm")
+	}
+
+	return s.client.Remove(s.resolve(args[0]), flagSet['r'])
+}
+
+func (s *sftpSession) rename(args []string) error {
+	if len(args) != 2 {
+		return s.usage("rename")
+	}
+
+	return s.client.Rename(s.resolve(args[0]), s.resolve(args[1]))
+}
+
+func (s *sftpSession) chmod(args []string) error {
+	if len(args) != 2 {
+		return s.usage("chmod")
+	}
+
+	mode, err := strconv.ParseUint(args[0], 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid mode %s", args[0])
+	}
+
+	return s.client.Chmod(s.resolve(args[1]), os.FileMode(mode))
+}
+
+func (s *sftpSession) help([]string) error {
+	names := make([]string, 0, len(s.commands))
+	for name := range s.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		_, _ = fmt.Fprintf(s.out, "%-28s %s\n", s.commands[name].usage, s.commands[name].help)
+	}
+
+	return nil
+}
+
+// execute runs a single command line.
+func (s *sftpSession) execute(line string) error {
+	args, err := splitArgs(line)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return nil
+	}
+
+	cmd, ok := s.commands[args[0]]
+	if !ok {
+		return fmt.Errorf("invalid command %q, see help", args[0])
+	}
+	if cmd.run == nil {
+		return errQuit
+	}
+
+	return cmd.run(s, args[1:])
+}
+
+// splitArgs splits a command line at whitespace, single and double quotes may be used
+// for arguments containing spaces.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	var quote rune
+	inArg := false
+
+	for _, c := range line {
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			current.WriteRune(c)
+		case c == '"' || c == '\'':
+			quote = c
+			inArg = true
+		case c == ' ' || c == '\t':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(c)
+			inArg = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+
+	return args, nil
+}
+
+// runBatch executes the commands read from reader and stops at the first failing one,
+// unless the command is prefixed with '-'.
+func (s *sftpSession) runBatch(reader io.Reader) error {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		ignoreError := strings.HasPrefix(line, "-")
+		line = strings.TrimPrefix(line, "-")
+
+		_, _ = fmt.Fprintf(s.out, "%s%s\n", prompt, line)
+		err := s.execute(line)
+		if errors.Is(err, errQuit) {
+			return nil
+		}
+		if err != nil {
+			if !ignoreError {
+				return err
+			}
+			_, _ = fmt.Fprintln(os.Stderr, err)
+		}
+	}
+
+	return scanner.Err()
+}
+
+func (s *sftpSession) runInteractive() error {
+	fd := int(os.Stdin.Fd())
+	oldState, err := term.MakeRaw(fd)
+	if err != nil {
+		return fmt.Errorf("failed to set raw mode: %w", err)
+	}
+	defer func() { _ = term.Restore(fd, oldState) }()
+
+	terminal := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, prompt)
+	terminal.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+		if key != '\t' {
+			return "", 0, false
+		}
+		return s.complete(terminal, line, pos)
+	}
+	s.out = terminal
+
+	for {
+		line, err := terminal.ReadLine()
+		if errors.Is(err, io.EOF) {
+			_, _ = fmt.Fprintln(terminal)
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		err = s.execute(line)
+		if errors.Is(err, errQuit) {
+			return nil
+		}
+		if err != nil {
+			_, _ = fmt.Fprintln(terminal, err)
+		}
+	}
+}
+
+// announcer prints each file as its transfer starts.
+type announcer struct {
+	out io.Writer
+}
+
+func (a *announcer) Start(transfer *wampshell.Transfer) {
+	verb := "Fetching"
+	if transfer.Upload {
+		verb = "Uploading"
+	}
+	_, _ = fmt.Fprintf(a.out, "%s %s to %s\n", verb, transfer.Source, transfer.Destination)
+}
+
+func (a *announcer) Add(int) {}
+func (a *announcer) Finish() {}
+
+type Options struct {
+	Batch                 string `short:"b" long:"batch" description:"Read commands from file, - for stdin"`
+	StrictHostKeyChecking bool   `long:"strict-host-key-checking" description:"Refuse to connect to unknown hosts"`
+	Args                  struct {
+		Target string `positional-arg-name:"[user@]host[:port]" required:"true"`
+	} `positional-args:"yes"`
+}
+
+func main() {
+	var opts Options
+	parser := flags.NewParser(&opts, flags.Default)
+
+	if _, err := parser.Parse(); err != nil {
+		log.Fatal(err)
+	}
+
+	user, host := os.Getenv("USER"), opts.Args.Target
+	if strings.Contains(host, "@") {
+		parts := strings.SplitN(host, "@", 2)
+		user, host = parts[0], parts[1]
+	}
+
+	port := "8022"
+	if strings.Contains(host, ":") {
+		parts := strings.SplitN(host, ":", 2)
+		host, port = parts[0], parts[1]
+	}
+
+	session, keys, err := wampshell.Connect(context.Background(), host, port, user, opts.StrictHostKeyChecking)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() { _ = session.Leave() }()
+
+	s := &sftpSession{
+		client:   wampshell.NewFileClient(session, keys),
+		commands: newCommands(),
+		out:      os.Stdout,
+	}
+
+	switch {
+	case opts.Batch == "-" || (opts.Batch == "" && !term.IsTerminal(int(os.Stdin.Fd()))):
+		err = s.runBatch(os.Stdin)
+	case opts.Batch != "":
+		var file *os.File
+		if file, err = os.Open(opts.Batch); err != nil {
+			log.Fatalf("Failed to open batch file: %v", err)
+		}
+		err = s.runBatch(file)
+		_ = file.Close()
+	default:
+		err = s.runInteractive()
+	}
+
+	if err != nil {
+		_ = session.Leave()
+		log.Fatal(err)
+	}
+}
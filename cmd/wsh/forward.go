@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xconnio/wampshell"
+	"github.com/xconnio/xconn-go"
+)
+
+const (
+	procedureForward       = "wampshell.forward.dial"
+	procedureForwardListen = "wampshell.forward.listen"
+	forwardDialTimeout     = 10 * time.Second
+)
+
+// splitForwardSpec splits a forwarding specification at colons that are not inside
+// the brackets of an IPv6 address.
+func splitForwardSpec(spec string) []string {
+	var fields []string
+	depth, start := 0, 0
+	for i, c := range spec {
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ':':
+			if depth == 0 {
+				fields = append(fields, spec[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	return append(fields, spec[start:])
+}
+
+// parseForward parses a -L or -R specification, [bind_address:]port:host:hostport.
+// Like ssh, the listener is bound to the loopback interface unless an address is
+// given.
+func parseForward(spec string) (listen, target string, err error) {
+	fields := splitForwardSpec(spec)
+	bind := "localhost"
+	switch len(fields) {
+	case 3:
+	case 4:
+		bind, fields = fields[0], fields[1:]
+	default:
+		return "", "", fmt.Errorf("invalid forward %q, expected [bind_address:]port:host:hostport", spec)
+	}
+
+	if bind == "*" {
+		bind = ""
+	}
+
+	listen = net.JoinHostPort(trimBrackets(bind), fields[0])
+	target = net.JoinHostPort(trimBrackets(fields[1]), fields[2])
+	return listen, target, nil
+}
+
+// trimBrackets removes the brackets around an IPv6 address, net.JoinHostPort adds
+// them again.
+func trimBrackets(host string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
+// forwarder relays connections between this host and wshd. Local forwards are
+// accepted here and dialed by wshd, remote forwards the other way around. Each
+// connection is a progressive call of its own.
+type forwarder struct {
+	session *xconn.Session
+	keys    *wampshell.KeyPair
+	nextID  atomic.Uint64
+
+	// targets are the addresses dialed for the connections of remote forwards
+	targets map[uint64]string
+	sync.Mutex
+}
+
+func newForwarder(session *xconn.Session, keys *wampshell.KeyPair) *forwarder {
+	return &forwarder{session: session, keys: keys, targets: make(map[uint64]string)}
+}
+
+// serve forwards every connection accepted by listener to address.
+func (f *forwarder) serve(listener net.Listener, address string) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("Stopped forwarding %s: %v", listener.Addr(), err)
+			return
+		}
+
+		go f.forward(conn, address)
+	}
+}
+
+// serveSOCKS forwards every connection accepted by listener to the address that its
+// SOCKS5 client asks for.
+func (f *forwarder) serveSOCKS(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("Stopped SOCKS proxy on %s: %v", listener.Addr(), err)
+			return
+		}
+
+		go func() {
+			address, err := socksHandshake(conn)
+			if err != nil {
+				log.Printf("SOCKS handshake with %s failed: %v", conn.RemoteAddr(), err)
+				_ = conn.Close()
+				return
+			}
+
+			f.forward(conn, address)
+		}()
+	}
+}
+
+// forward relays conn to address, which is dialed by wshd.
+func (f *forwarder) forward(conn net.Conn, address string) {
+	request, err := json.Marshal(&wampshell.ForwardRequest{Address: address})
+	if err == nil {
+		err = wampshell.ForwardConn(f.session, procedureForward, f.keys, f.nextID.Add(1), request, conn)
+	} else {
+		_ = conn.Close()
+	}
+	if err != nil {
+		log.Printf("Forwarding to %s failed: %v", address, err)
+	}
+}
+
+// registerRemote registers the procedure wshd calls for every connection that
+// arrives at one of the remote forwards of this session.
+func (f *forwarder) registerRemote() error {
+	handler := wampshell.NewForwardHandler(func(uint64) (*wampshell.KeyPair, bool) {
+		return f.keys, true
+	}, f.dialRemote)
+
+	procedure := fmt.Sprintf("%s.%d", wampshell.ProcedureForwardConnect, f.session.ID())
+	return f.session.Register(procedure, handler.Handle).Do().Err
+}
+
+func (f *forwarder) dialRemote(_ uint64, body []byte) (net.Conn, error) {
+	var request wampshell.ForwardConnection
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, err
+	}
+
+	f.Lock()
+	target, ok := f.targets[request.Listener]
+	f.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown remote forward %d", request.Listener)
+	}
+
+	return net.DialTimeout("tcp", target, forwardDialTimeout)
+}
+
+// listenRemote asks wshd to listen on address and forward the connections to target
+// through this host. The call lasts as long as the forward.
+func (f *forwarder) listenRemote(address, target string) error {
+	id := f.nextID.Add(1)
+	f.Lock()
+	f.targets[id] = target
+	f.Unlock()
+
+	request, err := json.Marshal(&wampshell.ForwardRequest{Address: address})
+	if err != nil {
+		return err
+	}
+	header, err := wampshell.EncryptPayload(wampshell.NewStreamMessage(id, request), f.keys.Send)
+	if err != nil {
+		return err
+	}
+
+	firstProgress := true
+	callResponse := f.session.Call(procedureForwardListen).
+		ProgressSender(func(ctx context.Context) *xconn.Progress {
+			if firstProgress {
+				firstProgress = false
+				return xconn.NewProgress(header)
+			}
+
+			// the forward is only stopped by leaving the session
+			<-ctx.Done()
+			payload, _ := wampshell.EncryptPayload(wampshell.NewStreamMessage(id, nil), f.keys.Send)
+			return xconn.NewFinalProgress(payload)
+		}).
+		ProgressReceiver(func(result *xconn.InvocationResult) {
+			if len(result.Args) == 0 {
+				return
+			}
+
+			payload, ok := result.Args[0].([]byte)
+			if !ok {
+				return
+			}
+			reply, err := wampshell.DecryptPayload(payload, f.keys.Receive)
+			if err != nil {
+				return
+			}
+
+			var listening wampshell.ForwardRequest
+			if err = json.Unmarshal(reply, &listening); err == nil {
+				log.Printf("Forwarding remote %s to %s", listening.Address, target)
+			}
+		}).Do()
+
+	return callResponse.Err
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSplitForwardSpec(t *testing.T) {
+	tests := []struct {
+		spec string
+		want []string
+	}{
+		{spec: "8080", want: []string{"8080"}},
+		{spec: "8080:localhost:80", want: []string{"8080", "localhost", "80"}},
+		{spec: "[::1]:8080:[2001:db8::1]:80", want: []string{"[::1]", "8080", "[2001:db8::1]", "80"}},
+		{spec: "", want: []string{""}},
+	}
+
+	for _, tt := range tests {
+		if got := splitForwardSpec(tt.spec); !slices.Equal(got, tt.want) {
+			t.Errorf("splitForwardSpec(%q) = %q, want %q", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestParseForward(t *testing.T) {
+	tests := []struct {
+		spec    string
+		listen  string
+		target  string
+		invalid bool
+	}{
+		{spec: "8080:localhost:80", listen: "localhost:8080", target: "localhost:80"},
+		{spec: "0.0.0.0:8080:db:5432", listen: "0.0.0.0:8080", target: "db:5432"},
+		{spec: "*:8080:db:5432", listen: ":8080", target: "db:5432"},
+		{spec: ":8080:db:5432", listen: ":8080", target: "db:5432"},
+		{spec: "8080:[2001:db8::1]:80", listen: "localhost:8080", target: "[2001:db8::1]:80"},
+		{spec: "[::1]:8080:[::1]:80", listen: "[::1]:8080", target: "[::1]:80"},
+		{spec: "8080", invalid: true},
+		{spec: "8080:80", invalid: true},
+		{spec: "a:8080:b:80:c", invalid: true},
+		{spec: "8080:2001:db8::1:80", invalid: true},
+	}
+
+	for _, tt := range tests {
+		listen, target, err := parseForward(tt.spec)
+		if tt.invalid {
+			if err == nil {
+				t.Errorf("parseForward(%q) = %q, %q, expected an error", tt.spec, listen, target)
+			}
+			continue
+		}
+		if err != nil || listen != tt.listen || target != tt.target {
+			t.Errorf("parseForward(%q) = %q, %q, %v, want %q, %q", tt.spec, listen, target, err, tt.listen, tt.target)
+		}
+	}
+}
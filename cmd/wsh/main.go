@@ -2,10 +2,14 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"github.com/jessevdk/go-flags"
 	"golang.org/x/term"
@@ -26,110 +30,225 @@ const (
 	topicAnswererOnCandidate = "wampshell.webrtc.answerer.on_candidate"
 )
 
-func startInteractiveShell(session *xconn.Session, keys *wampshell.KeyPair) error {
-	const nonceSize = 12
+func runCommand(session *xconn.Session, keys *wampshell.KeyPair, args []string,
+	viaShell, allocatePTY bool) (*wampshell.ExitStatus, error) {
+	request := wampshell.ExecRequest{
+		Argv:  args,
+		Shell: viaShell,
+		PTY:   allocatePTY,
+	}
+	if allocatePTY {
+		request.Term = os.Getenv("TERM")
+	}
+	if viaShell {
+		request.Argv = []string{strings.Join(args, " ")}
+	}
 
-	fd := int(os.Stdin.Fd())
-	oldState, err := term.MakeRaw(fd)
+	b, err := json.Marshal(request)
 	if err != nil {
-		return fmt.Errorf("failed to set raw mode: %w", err)
+		return nil, fmt.Errorf("encoding request failed: %w", err)
 	}
-	defer func() { _ = term.Restore(fd, oldState) }()
 
-	firstProgress := true
+	stream, err := wampshell.NewStream(keys.Send)
+	if err != nil {
+		return nil, err
+	}
 
-	readAndEncrypt := func() (*xconn.Progress, error) {
-		buf := make([]byte, 1024)
-		n, err := os.Stdin.Read(buf)
-		if err != nil {
-			return nil, fmt.Errorf("read error: %w", err)
-		}
+	payload, err := stream.Encrypt(b)
+	if err != nil {
+		return nil, fmt.Errorf("encryption error: %w", err)
+	}
 
-		ciphertext, nonce, err := berncrypt.EncryptChaCha20Poly1305(buf[:n], keys.Send)
+	fd := int(os.Stdin.Fd())
+	if allocatePTY && term.IsTerminal(fd) {
+		oldState, err := term.MakeRaw(fd)
 		if err != nil {
-			return nil, fmt.Errorf("encryption error: %w", err)
+			return nil, fmt.Errorf("failed to set raw mode: %w", err)
 		}
-		payload := append(nonce, ciphertext...)
-		return xconn.NewProgress(payload), nil
+		defer func() { _ = term.Restore(fd, oldState) }()
 	}
 
-	decryptAndWrite := func(encData []byte) error {
-		if len(encData) < nonceSize {
-			return fmt.Errorf("invalid payload from server: too short")
-		}
-		plain, err := berncrypt.DecryptChaCha20Poly1305(encData[nonceSize:], encData[:nonceSize], keys.Receive)
-		if err != nil {
-			return fmt.Errorf("decryption error: %w", err)
+	input := make(chan []byte)
+	go func() {
+		defer close(input)
+		for {
+			buf := make([]byte, 32*1024)
+			n, err := os.Stdin.Read(buf)
+			if n > 0 {
+				input <- buf[:n]
+			}
+			if err != nil {
+				return
+			}
 		}
-		_, err = os.Stdout.Write(plain)
-		return err
-	}
+	}()
+
+	exited := make(chan struct{})
+	firstProgress := true
 
-	call := session.Call(procedureInteractive).
+	var outputErr error
+	callResponse := session.Call(procedureExec).
 		ProgressSender(func(ctx context.Context) *xconn.Progress {
 			if firstProgress {
 				firstProgress = false
-				return xconn.NewProgress()
+				return xconn.NewProgress(payload)
 			}
-			progress, err := readAndEncrypt()
-			if err != nil {
-				fmt.Fprintln(os.Stderr, err)
-				return xconn.NewFinalProgress()
+
+			select {
+			case data, ok := <-input:
+				if !ok {
+					return stream.Final()
+				}
+				payload, err := stream.Encrypt(data)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "encryption error: %v\n", err)
+					return stream.Abort()
+				}
+				return xconn.NewProgress(payload)
+			case <-exited:
+				return stream.Final()
 			}
-			return progress
 		}).
 		ProgressReceiver(func(result *xconn.InvocationResult) {
-			if len(result.Args) > 0 {
-				if err := decryptAndWrite(result.Args[0].([]byte)); err != nil {
-					fmt.Fprintln(os.Stderr, err)
-				}
-			} else {
-				_ = term.Restore(fd, oldState)
-				os.Exit(0)
+			if len(result.Args) == 0 {
+				close(exited)
+				return
+			}
+			if outputErr != nil {
+				return
+			}
+			encryptedOutput, ok := result.Args[0].([]byte)
+			if !ok || len(encryptedOutput) < 12 {
+				outputErr = fmt.Errorf("invalid output payload from server")
+				return
+			}
+
+			plainOutput, err := berncrypt.DecryptChaCha20Poly1305(encryptedOutput[12:], encryptedOutput[:12], keys.Receive)
+			if err != nil {
+				outputErr = fmt.Errorf("decryption failed: %w", err)
+				return
+			}
+			if len(plainOutput) == 0 {
+				outputErr = fmt.Errorf("invalid output payload from server")
+				return
+			}
+
+			switch plainOutput[0] {
+			case wampshell.StreamStdout:
+				_, outputErr = os.Stdout.Write(plainOutput[1:])
+			case wampshell.StreamStderr:
+				_, outputErr = os.Stderr.Write(plainOutput[1:])
+			default:
+				outputErr = fmt.Errorf("unknown output stream %d", plainOutput[0])
 			}
 		}).Do()
+	if callResponse.Err != nil {
+		return nil, fmt.Errorf("command execution failed: %w", callResponse.Err)
+	}
+	if outputErr != nil {
+		return nil, outputErr
+	}
 
-	if call.Err != nil {
-		return fmt.Errorf("shell error: %w", call.Err)
+	encryptedStatus, err := callResponse.Args.Bytes(0)
+	if err != nil {
+		return nil, fmt.Errorf("exit status parsing error: %w", err)
 	}
-	return nil
+
+	plainStatus, err := wampshell.DecryptPayload(encryptedStatus, keys.Receive)
+	if err != nil {
+		return nil, fmt.Errorf("decryption failed: %w", err)
+	}
+
+	var status wampshell.ExitStatus
+	if err = json.Unmarshal(plainStatus, &status); err != nil {
+		return nil, fmt.Errorf("exit status parsing error: %w", err)
+	}
+
+	return &status, nil
 }
 
-func runCommand(session *xconn.Session, keys *wampshell.KeyPair, args []string) error {
-	b := []byte(strings.Join(args, " "))
+func exitCode(status *wampshell.ExitStatus) int {
+	if status.Signal != 0 {
+		fmt.Fprintf(os.Stderr, "remote command terminated by signal: %s\n", syscall.Signal(status.Signal))
+		return 128 + status.Signal
+	}
+
+	return status.Code
+}
 
-	ciphertext, nonce, err := berncrypt.EncryptChaCha20Poly1305(b, keys.Send)
+type Options struct {
+	Interactive           bool     `short:"i" long:"interactive" description:"Force interactive shell"`
+	PeerToPeer            bool     `long:"p2p" description:"Use WebRTC for peer-to-peer connection"`
+	ForcePTY              bool     `short:"t" description:"Force pseudo-terminal allocation"`
+	DisablePTY            bool     `short:"T" description:"Disable pseudo-terminal allocation"`
+	Shell                 bool     `long:"shell" description:"Run through the remote shell, implied by a single argument"`
+	StrictHostKeyChecking bool     `long:"strict-host-key-checking" description:"Refuse to connect to unknown hosts"`
+	LocalForward          []string `short:"L" description:"Forward a local port, [bind_address:]port:host:hostport"`
+	RemoteForward         []string `short:"R" description:"Forward a remote port, [bind_address:]port:host:hostport"`
+	DynamicForward        []string `short:"D" description:"Run a local SOCKS5 proxy, [bind_address:]port"`
+	NoCommand             bool     `short:"N" description:"Do not run a remote command, only forward or serve as master"`
+	Master                bool     `short:"M" description:"Share the connection with later wsh, wcp and wsftp invocations"`
+	Args                  struct {
+		Target string   `positional-arg-name:"host" required:"true"`
+		Cmd    []string `positional-arg-name:"command"`
+	} `positional-args:"yes"`
+}
+
+// connect opens the session to wshd at host:port, over WebRTC if requested, and
+// verifies its host key.
+func connect(opts *Options, user, host, port string) (*xconn.Session, *wampshell.KeyPair, error) {
+	privateKey, err := wampshell.ReadPrivateKeyFromFile()
 	if err != nil {
-		return fmt.Errorf("encryption error: %w", err)
+		return nil, nil, fmt.Errorf("error reading private key: %w", err)
 	}
 
-	payload := append(nonce, ciphertext...)
+	authenticator, err := auth.NewCryptoSignAuthenticator("", privateKey, map[string]any{"user": user})
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating crypto sign authenticator: %w", err)
+	}
 
-	callResponse := session.Call(procedureExec).Args(payload).Do()
-	if callResponse.Err != nil {
-		return fmt.Errorf("command execution failed: %w", callResponse.Err)
+	client := xconn.Client{
+		SerializerSpec: wampshell.CapnprotoSerializerSpec,
+		Authenticator:  authenticator,
 	}
 
-	encryptedOutput, err := callResponse.Args.Bytes(0)
+	url := fmt.Sprintf("rs://%s:%s", host, port)
+
+	session, err := client.Connect(context.Background(), url, defaultRealm)
 	if err != nil {
-		return fmt.Errorf("output parsing error: %w", err)
+		return nil, nil, fmt.Errorf("failed to connect via TCP: %w", err)
 	}
 
-	plainOutput, err := berncrypt.DecryptChaCha20Poly1305(encryptedOutput[12:], encryptedOutput[:12], keys.Receive)
+	if opts.PeerToPeer {
+		config := &wamp_webrtc_go.ClientConfig{
+			Realm:                    defaultRealm,
+			ProcedureWebRTCOffer:     procedureWebRTCOffer,
+			TopicAnswererOnCandidate: topicAnswererOnCandidate,
+			TopicOffererOnCandidate:  topicOffererOnCandidate,
+			Serializer:               xconn.CBORSerializerSpec,
+			Authenticator:            authenticator,
+			Session:                  session,
+		}
+
+		session, err = wamp_webrtc_go.ConnectWAMP(config)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to connect via WebRTC: %w", err)
+		}
+	}
+
+	keys, err := wampshell.ExchangeKeys(session, privateKey, user)
 	if err != nil {
-		return fmt.Errorf("decryption failed: %w", err)
+		_ = session.Leave()
+		return nil, nil, fmt.Errorf("failed to exchange keys: %w", err)
 	}
-	fmt.Print(string(plainOutput))
-	return nil
-}
 
-type Options struct {
-	Interactive bool `short:"i" long:"interactive" description:"Force interactive shell"`
-	PeerToPeer  bool `long:"p2p" description:"Use WebRTC for peer-to-peer connection"`
-	Args        struct {
-		Target string   `positional-arg-name:"host" required:"true"`
-		Cmd    []string `positional-arg-name:"command"`
-	} `positional-args:"yes"`
+	if err = wampshell.VerifyHostKey(net.JoinHostPort(host, port), keys.PeerPublicKey,
+		opts.StrictHostKeyChecking); err != nil {
+		_ = session.Leave()
+		return nil, nil, fmt.Errorf("host key verification failed: %w", err)
+	}
+
+	return session, keys, nil
 }
 
 func main() {
@@ -144,12 +263,12 @@ func main() {
 	target := opts.Args.Target
 	args := opts.Args.Cmd
 
-	var host, port string
+	var user, host, port string
 	if strings.Contains(target, "@") {
 		parts := strings.SplitN(target, "@", 2)
-		_, host = parts[0], parts[1]
+		user, host = parts[0], parts[1]
 	} else {
-		user := os.Getenv("USER")
+		user = os.Getenv("USER")
 		if user == "" {
 			log.Fatalln("Error: user not provided and $USER not set")
 		}
@@ -163,59 +282,119 @@ func main() {
 		port = "8022"
 	}
 
-	privateKey, err := wampshell.ReadPrivateKeyFromFile()
+	// forwarded connections are not relayed by a master, they need a session of their own
+	forwarding := len(opts.LocalForward) > 0 || len(opts.RemoteForward) > 0 || len(opts.DynamicForward) > 0
+
+	controlPath, err := wampshell.ControlPath(user, host, port)
 	if err != nil {
-		log.Fatalf("Error reading private key: %s", err)
+		log.Fatal(err)
 	}
 
-	authenticator, err := auth.NewCryptoSignAuthenticator("", privateKey, nil)
-	if err != nil {
-		log.Fatal("Error creating crypto sign authenticator:", err)
+	var session *xconn.Session
+	var keys *wampshell.KeyPair
+	if !opts.Master && !forwarding {
+		session, keys, _ = wampshell.ConnectControl(context.Background(), controlPath)
+	}
+	if session == nil {
+		if session, keys, err = connect(&opts, user, host, port); err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	client := xconn.Client{
-		SerializerSpec: wampshell.CapnprotoSerializerSpec,
-		Authenticator:  authenticator,
+	var master *wampshell.ControlMaster
+	if opts.Master {
+		if master, err = wampshell.ServeControl(controlPath, session, keys); err != nil {
+			log.Fatalf("Failed to start master connection: %v", err)
+		}
+	}
+	closeMaster := func() {
+		if master != nil {
+			_ = master.Close()
+		}
 	}
 
-	url := fmt.Sprintf("rs://%s:%s", host, port)
+	forwarder := newForwarder(session, keys)
+	for _, spec := range opts.LocalForward {
+		listen, address, err := parseForward(spec)
+		if err != nil {
+			log.Fatal(err)
+		}
 
-	session, err := client.Connect(context.Background(), url, defaultRealm)
-	if err != nil {
-		log.Fatalf("Failed to connect via TCP: %v", err)
+		listener, err := net.Listen("tcp", listen)
+		if err != nil {
+			log.Fatalf("Failed to listen for forwarding: %v", err)
+		}
+		go forwarder.serve(listener, address)
 	}
 
-	if opts.PeerToPeer {
-		config := &wamp_webrtc_go.ClientConfig{
-			Realm:                    defaultRealm,
-			ProcedureWebRTCOffer:     procedureWebRTCOffer,
-			TopicAnswererOnCandidate: topicAnswererOnCandidate,
-			TopicOffererOnCandidate:  topicOffererOnCandidate,
-			Serializer:               xconn.CBORSerializerSpec,
-			Authenticator:            authenticator,
-			Session:                  session,
+	for _, spec := range opts.DynamicForward {
+		listen, err := parseDynamicForward(spec)
+		if err != nil {
+			log.Fatal(err)
 		}
 
-		session, err = wamp_webrtc_go.ConnectWAMP(config)
+		listener, err := net.Listen("tcp", listen)
 		if err != nil {
-			log.Fatalf("Failed to connect via WebRTC: %v", err)
+			log.Fatalf("Failed to listen for SOCKS proxy: %v", err)
 		}
+		go forwarder.serveSOCKS(listener)
 	}
 
-	keys, err := wampshell.ExchangeKeys(session)
-	if err != nil {
-		log.Fatalf("Failed to exchange keys: %v", err)
+	if len(opts.RemoteForward) > 0 {
+		if err = forwarder.registerRemote(); err != nil {
+			log.Fatalf("Failed to register for remote forwarding: %v", err)
+		}
+	}
+	for _, spec := range opts.RemoteForward {
+		listen, target, err := parseForward(spec)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		go func() {
+			if err := forwarder.listenRemote(listen, target); err != nil {
+				log.Printf("Remote forwarding of %s failed: %v", listen, err)
+			}
+		}()
+	}
+
+	if opts.NoCommand {
+		// forwarding and the master connection run until wsh is interrupted
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+		<-interrupt
+		closeMaster()
+		_ = session.Leave()
+		return
 	}
 
 	if opts.Interactive || len(args) == 0 {
-		err := startInteractiveShell(session, keys)
+		reconnect := func() (*xconn.Session, *wampshell.KeyPair, error) {
+			return connect(&opts, user, host, port)
+		}
+		err := startInteractiveShell(session, keys, reconnect)
+		closeMaster()
 		if err != nil {
 			log.Fatal(err)
 		}
+		return
 	}
 
-	err = runCommand(session, keys, args)
+	allocatePTY := term.IsTerminal(int(os.Stdin.Fd())) && term.IsTerminal(int(os.Stdout.Fd()))
+	if opts.ForcePTY {
+		allocatePTY = true
+	} else if opts.DisablePTY {
+		allocatePTY = false
+	}
+
+	// a single argument is a command line like 'tar x | gzip', anything else is run exactly as given
+	viaShell := opts.Shell || len(args) == 1
+
+	status, err := runCommand(session, keys, args, viaShell, allocatePTY)
+	closeMaster()
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	os.Exit(exitCode(status))
 }
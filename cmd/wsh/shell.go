@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/term"
+
+	"github.com/xconnio/wampshell"
+	"github.com/xconnio/xconn-go"
+)
+
+var errConnectionLost = errors.New("connection lost")
+
+// shellClient is the local end of a resumable interactive shell. It counts the
+// output it received, so that after a reconnect wshd can replay what was missed.
+type shellClient struct {
+	fd     int
+	input  chan []byte
+	resize chan os.Signal
+
+	token    []byte
+	received uint64
+	sync.Mutex
+}
+
+// startInteractiveShell runs the remote login shell on the local terminal. When the
+// connection is lost it reconnects and resumes the shell, which wshd keeps running
+// for wampshell.ShellGracePeriod.
+func startInteractiveShell(session *xconn.Session, keys *wampshell.KeyPair,
+	reconnect func() (*xconn.Session, *wampshell.KeyPair, error)) error {
+	fd := int(os.Stdin.Fd())
+	oldState, err := term.MakeRaw(fd)
+	if err != nil {
+		return fmt.Errorf("failed to set raw mode: %w", err)
+	}
+	defer func() { _ = term.Restore(fd, oldState) }()
+
+	shell := &shellClient{
+		fd:     fd,
+		input:  make(chan []byte),
+		resize: make(chan os.Signal, 1),
+		token:  make([]byte, wampshell.ShellTokenSize),
+	}
+
+	signal.Notify(shell.resize, syscall.SIGWINCH)
+	defer signal.Stop(shell.resize)
+
+	go func() {
+		defer close(shell.input)
+		for {
+			buf := make([]byte, 1024)
+			n, err := os.Stdin.Read(buf)
+			if n > 0 {
+				shell.input <- buf[:n]
+			}
+			if err != nil {
+				if !errors.Is(err, io.EOF) {
+					fmt.Fprintf(os.Stderr, "read error: %v\r\n", err)
+				}
+				return
+			}
+		}
+	}()
+
+	for {
+		err = shell.attach(session, keys)
+		if !errors.Is(err, errConnectionLost) {
+			return err
+		}
+
+		// leaving may hang on a dead connection, the session is abandoned either way
+		go func(session *xconn.Session) { _ = session.Leave() }(session)
+
+		fmt.Fprint(os.Stderr, "\r\nConnection lost, reconnecting...\r\n")
+		deadline := time.Now().Add(wampshell.ShellGracePeriod)
+		for {
+			if session, keys, err = reconnect(); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("reconnecting failed: %w", err)
+			}
+			time.Sleep(wampshell.ShellKeepaliveInterval)
+		}
+	}
+}
+
+func (c *shellClient) resumable() bool {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, b := range c.token {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *shellClient) size() (rows, cols uint16) {
+	width, height, err := term.GetSize(c.fd)
+	if err != nil {
+		return 0, 0
+	}
+
+	return uint16(height), uint16(width) //nolint:gosec
+}
+
+// receive handles a message of wshd, keepalives only count as a sign of life.
+func (c *shellClient) receive(message []byte) {
+	if len(message) == 0 {
+		return
+	}
+
+	switch message[0] {
+	case wampshell.MessageSession:
+		token, offset, err := wampshell.ParseSessionMessage(message)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\r\n", err)
+			return
+		}
+		c.Lock()
+		copy(c.token, token)
+		c.received = offset
+		c.Unlock()
+	case wampshell.MessageData:
+		if _, err := os.Stdout.Write(message[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\r\n", err)
+		}
+		c.Lock()
+		c.received += uint64(len(message) - 1)
+		c.Unlock()
+	}
+}
+
+// attach opens or resumes the shell over session and relays the terminal until the
+// shell exits or the connection is lost, which is reported as errConnectionLost.
+func (c *shellClient) attach(session *xconn.Session, keys *wampshell.KeyPair) error {
+	// the shell is resumed by its token, every call is a stream of its own
+	stream, err := wampshell.NewStream(keys.Send)
+	if err != nil {
+		return err
+	}
+
+	// once the connection is considered lost nothing may be sent or written anymore,
+	// the next session resumes from what was received until then
+	dead := make(chan struct{})
+	exited := make(chan struct{})
+	var exitOnce sync.Once
+	var lastReceived atomic.Int64
+	lastReceived.Store(time.Now().UnixNano())
+
+	encrypt := func(message []byte) *xconn.Progress {
+		payload, err := stream.Encrypt(message)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "encryption error: %v\r\n", err)
+			return stream.Abort()
+		}
+		return xconn.NewProgress(payload)
+	}
+
+	keepalive := time.NewTicker(wampshell.ShellKeepaliveInterval)
+	defer keepalive.Stop()
+
+	rows, cols := c.size()
+	c.Lock()
+	resume := wampshell.NewResumeMessage(c.token, c.received, rows, cols, os.Getenv("TERM"))
+	c.Unlock()
+
+	firstProgress := true
+	nextProgress := func(ctx context.Context) *xconn.Progress {
+		if firstProgress {
+			firstProgress = false
+			return encrypt(resume)
+		}
+
+		for {
+			select {
+			case <-dead:
+				// only give up the call once the session is gone, a final message would
+				// end the shell
+				<-ctx.Done()
+				return xconn.NewFinalProgress()
+			default:
+			}
+
+			select {
+			case <-dead:
+			case data, ok := <-c.input:
+				if !ok {
+					return stream.Final()
+				}
+				return encrypt(wampshell.NewDataMessage(data))
+			case <-c.resize:
+				if rows, cols := c.size(); rows > 0 && cols > 0 {
+					return encrypt(wampshell.NewResizeMessage(rows, cols))
+				}
+			case <-keepalive.C:
+				if c.resumable() {
+					return encrypt(wampshell.NewKeepaliveMessage())
+				}
+			}
+		}
+	}
+
+	done := make(chan xconn.CallResponse, 1)
+	go func() {
+		done <- session.Call(procedureInteractive).
+			ProgressSender(nextProgress).
+			ProgressReceiver(func(result *xconn.InvocationResult) {
+				select {
+				case <-dead:
+					return
+				default:
+				}
+
+				if len(result.Args) == 0 {
+					exitOnce.Do(func() { close(exited) })
+					return
+				}
+
+				payload, ok := result.Args[0].([]byte)
+				if !ok {
+					return
+				}
+				message, err := wampshell.DecryptPayload(payload, keys.Receive)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "decryption error: %v\r\n", err)
+					return
+				}
+				lastReceived.Store(time.Now().UnixNano())
+				c.receive(message)
+			}).Do()
+	}()
+
+	watchdog := time.NewTicker(wampshell.ShellKeepaliveInterval)
+	defer watchdog.Stop()
+
+	for {
+		select {
+		case <-exited:
+			return nil
+		case response := <-done:
+			var wampErr *xconn.Error
+			switch {
+			case response.Err == nil:
+				return nil
+			case !c.resumable():
+				return fmt.Errorf("shell error: %w", response.Err)
+			case errors.As(response.Err, &wampErr) && wampErr.URI != wampshell.ErrorShellDetached:
+				return fmt.Errorf("shell error: %w", response.Err)
+			}
+			close(dead)
+			return errConnectionLost
+		case <-watchdog.C:
+			idle := time.Since(time.Unix(0, lastReceived.Load()))
+			if c.resumable() && idle > wampshell.ShellKeepaliveTimeout {
+				close(dead)
+				return errConnectionLost
+			}
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// The subset of SOCKS5 (RFC 1928) that wsh implements: no authentication and the
+// CONNECT command only.
+const (
+	socksVersion = 5
+
+	socksMethodNone         = 0x00
+	socksMethodNoAcceptable = 0xff
+
+	socksCommandConnect = 0x01
+
+	socksAddressIPv4   = 0x01
+	socksAddressDomain = 0x03
+	socksAddressIPv6   = 0x04
+
+	socksReplySucceeded           = 0x00
+	socksReplyCommandNotSupported = 0x07
+	socksReplyAddressNotSupported = 0x08
+
+	socksHandshakeTimeout = 30 * time.Second
+)
+
+// parseDynamicForward parses a -D specification, [bind_address:]port. Like -L the
+// proxy is bound to the loopback interface unless an address is given.
+func parseDynamicForward(spec string) (string, error) {
+	fields := splitForwardSpec(spec)
+	bind := "localhost"
+	switch len(fields) {
+	case 1:
+	case 2:
+		bind, fields = fields[0], fields[1:]
+	default:
+		return "", fmt.Errorf("invalid dynamic forward %q, expected [bind_address:]port", spec)
+	}
+
+	if bind == "*" {
+		bind = ""
+	}
+	bind = trimBrackets(bind)
+
+	return net.JoinHostPort(bind, fields[0]), nil
+}
+
+// socksHandshake negotiates with the SOCKS5 client on conn and returns the address
+// of its CONNECT request. On success the client has already been told that the
+// connection is established, failures to reach the address close it instead.
+func socksHandshake(conn net.Conn) (string, error) {
+	if err := conn.SetDeadline(time.Now().Add(socksHandshakeTimeout)); err != nil {
+		return "", err
+	}
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	if bytes.IndexByte(methods, socksMethodNone) < 0 {
+		_, _ = conn.Write([]byte{socksVersion, socksMethodNoAcceptable})
+		return "", fmt.Errorf("SOCKS client requires authentication")
+	}
+	if _, err := conn.Write([]byte{socksVersion, socksMethodNone}); err != nil {
+		return "", err
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", err
+	}
+	if request[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", request[0])
+	}
+	if request[1] != socksCommandConnect {
+		_ = socksReply(conn, socksReplyCommandNotSupported)
+		return "", fmt.Errorf("unsupported SOCKS command %d", request[1])
+	}
+
+	var host string
+	switch request[3] {
+	case socksAddressIPv4, socksAddressIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if request[3] == socksAddressIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksAddressDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		_ = socksReply(conn, socksReplyAddressNotSupported)
+		return "", fmt.Errorf("unsupported SOCKS address type %d", request[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+
+	// wshd dials the address, so success is reported before it is known whether it
+	// can be reached
+	if err := socksReply(conn, socksReplySucceeded); err != nil {
+		return "", err
+	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// socksReply answers a request with the unspecified IPv4 address as bound address.
+func socksReply(conn net.Conn, reply byte) error {
+	_, err := conn.Write([]byte{socksVersion, reply, 0, socksAddressIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestParseDynamicForward(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    string
+		invalid bool
+	}{
+		{spec: "1080", want: "localhost:1080"},
+		{spec: "0.0.0.0:1080", want: "0.0.0.0:1080"},
+		{spec: "*:1080", want: ":1080"},
+		{spec: "[::1]:1080", want: "[::1]:1080"},
+		{spec: "a:b:1080", invalid: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseDynamicForward(tt.spec)
+		if tt.invalid {
+			if err == nil {
+				t.Errorf("parseDynamicForward(%q) = %q, expected an error", tt.spec, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseDynamicForward(%q) = %q, %v, want %q", tt.spec, got, err, tt.want)
+		}
+	}
+}
+
+// socksExchange runs socksHandshake against a client that sends request and returns
+// the address of the handshake, everything the client received and the error of the
+// handshake. A truncated request is followed by closing the connection.
+func socksExchange(t *testing.T, request []byte, truncated bool) (string, []byte, error) {
+	t.Helper()
+
+	server, client := net.Pipe()
+	defer func() { _ = client.Close() }()
+
+	type result struct {
+		address string
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		address, err := socksHandshake(server)
+		_ = server.Close()
+		done <- result{address, err}
+	}()
+
+	received := make(chan []byte, 1)
+	go func() {
+		data, _ := io.ReadAll(client)
+		received <- data
+	}()
+
+	// the server may stop reading before the whole request was sent
+	_, _ = client.Write(request)
+	if truncated {
+		// writes to a pipe only return once they are read, so the server is waiting
+		// for the rest of the request
+		_ = client.Close()
+	}
+
+	r := <-done
+	return r.address, <-received, r.err
+}
+
+func TestSocksHandshake(t *testing.T) {
+	methods := []byte{socksVersion, 1, socksMethodNone}
+	selected := []byte{socksVersion, socksMethodNone}
+	succeeded := []byte{socksVersion, socksReplySucceeded, 0, socksAddressIPv4, 0, 0, 0, 0, 0, 0}
+
+	tests := []struct {
+		name    string
+		request []byte
+		address string
+		reply   []byte
+		// truncated requests end with the connection closed
+		truncated bool
+	}{
+		{
+			name:    "IPv4",
+			request: append(bytes.Clone(methods), socksVersion, socksCommandConnect, 0, socksAddressIPv4, 192, 0, 2, 1, 0, 80),
+			address: "192.0.2.1:80",
+			reply:   append(bytes.Clone(selected), succeeded...),
+		},
+		{
+			name: "IPv6",
+			request: append(append(bytes.Clone(methods), socksVersion, socksCommandConnect, 0, socksAddressIPv6),
+				append(net.ParseIP("2001:db8::1"), 0x1f, 0x90)...),
+			address: "[2001:db8::1]:8080",
+			reply:   append(bytes.Clone(selected), succeeded...),
+		},
+		{
+			name: "domain",
+			request: append(append(bytes.Clone(methods), socksVersion, socksCommandConnect, 0, socksAddressDomain, 11),
+				append([]byte("example.com"), 1, 187)...),
+			address: "example.com:443",
+			reply:   append(bytes.Clone(selected), succeeded...),
+		},
+		{
+			name:    "several methods",
+			request: []byte{socksVersion, 2, 0x02, socksMethodNone, socksVersion, 1, 0, 1, 127, 0, 0, 1, 0, 22},
+			address: "127.0.0.1:22",
+			reply:   append(bytes.Clone(selected), succeeded...),
+		},
+		{
+			name:    "SOCKS4",
+			request: []byte{4, 1, 0, 80, 192, 0, 2, 1, 0},
+		},
+		{
+			name:    "authentication required",
+			request: []byte{socksVersion, 1, 0x02},
+			reply:   []byte{socksVersion, socksMethodNoAcceptable},
+		},
+		{
+			name:    "BIND",
+			request: append(bytes.Clone(methods), socksVersion, 0x02, 0, socksAddressIPv4, 192, 0, 2, 1, 0, 80),
+			reply: append(bytes.Clone(selected),
+				socksVersion, socksReplyCommandNotSupported, 0, socksAddressIPv4, 0, 0, 0, 0, 0, 0),
+		},
+		{
+			name:    "unknown address type",
+			request: append(bytes.Clone(methods), socksVersion, socksCommandConnect, 0, 0x05),
+			reply: append(bytes.Clone(selected),
+				socksVersion, socksReplyAddressNotSupported, 0, socksAddressIPv4, 0, 0, 0, 0, 0, 0),
+		},
+		{
+			name:      "truncated",
+			request:   append(bytes.Clone(methods), socksVersion, socksCommandConnect, 0, socksAddressIPv4, 192, 0),
+			reply:     selected,
+			truncated: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			address, reply, err := socksExchange(t, tt.request, tt.truncated)
+			if tt.address == "" && err == nil {
+				t.Fatalf("expected an error, got address %q", address)
+			}
+			if tt.address != "" && (err != nil || address != tt.address) {
+				t.Fatalf("got %q, %v, want %q", address, err, tt.address)
+			}
+			if !bytes.Equal(reply, tt.reply) {
+				t.Fatalf("client received %v, want %v", reply, tt.reply)
+			}
+		})
+	}
+}
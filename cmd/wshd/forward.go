@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xconnio/wampshell"
+	"github.com/xconnio/xconn-go"
+)
+
+const (
+	forwardDialTimeout = 10 * time.Second
+	// forwardProbeInterval is how often wshd checks that the client of a remote
+	// forward is still connected.
+	forwardProbeInterval = 30 * time.Second
+)
+
+// requirePortForwarding wraps handler so that it is only run for keys that may
+// forward ports.
+func requirePortForwarding(e *wampshell.EncryptionManager, handler xconn.InvocationHandler) xconn.InvocationHandler {
+	return func(ctx context.Context, inv *xconn.Invocation) *xconn.InvocationResult {
+		options, err := e.KeyOptions(inv.Caller())
+		if err != nil {
+			return xconn.NewInvocationError("wamp.error.not_authorized", err.Error())
+		}
+		if !options.AllowsPortForwarding() {
+			return xconn.NewInvocationError("wamp.error.not_authorized", "port forwarding is disabled for this key")
+		}
+
+		return handler(ctx, inv)
+	}
+}
+
+// handleForward relays TCP connections that the caller accepted locally to the
+// address in their request, which is dialed from this host.
+func handleForward(e *wampshell.EncryptionManager) xconn.InvocationHandler {
+	forward := wampshell.NewForwardHandler(e.Key, func(caller uint64, body []byte) (net.Conn, error) {
+		var request wampshell.ForwardRequest
+		if err := json.Unmarshal(body, &request); err != nil {
+			return nil, err
+		}
+
+		// -L and -D forwards are both dialed here, so permitopen= covers either
+		options, err := e.KeyOptions(caller)
+		if err != nil {
+			return nil, err
+		}
+		if !options.AllowsOpen(request.Address) {
+			return nil, fmt.Errorf("forwarding to %s is not permitted for this key", request.Address)
+		}
+
+		conn, err := net.DialTimeout("tcp", request.Address, forwardDialTimeout)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("forwarding connection of caller %d to %s", caller, request.Address)
+
+		return conn, nil
+	})
+	e.OnLeave(forward.Forget)
+
+	return requirePortForwarding(e, forward.Handle)
+}
+
+// remoteListener accepts the connections of a remote forward until it is closed.
+type remoteListener struct {
+	listener net.Listener
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func (l *remoteListener) close() {
+	l.once.Do(func() {
+		close(l.closed)
+		_ = l.listener.Close()
+	})
+}
+
+// remoteForwardSession listens on behalf of its callers and relays every accepted
+// connection back to them. The callback procedure of a caller is registered by its
+// own session, so it disappears when the caller leaves, which ends its listeners.
+type remoteForwardSession struct {
+	session *xconn.Session
+	// gatewayPorts allows listening on other addresses than loopback
+	gatewayPorts bool
+	listeners    map[forwardKey]*remoteListener
+	nextID       atomic.Uint64
+	sync.Mutex
+}
+
+// forwardKey identifies a remote forward, the id is chosen by the caller.
+type forwardKey struct {
+	caller uint64
+	id     uint64
+}
+
+func newRemoteForwardSession(session *xconn.Session, gatewayPorts bool) *remoteForwardSession {
+	return &remoteForwardSession{
+		session:      session,
+		gatewayPorts: gatewayPorts,
+		listeners:    make(map[forwardKey]*remoteListener),
+	}
+}
+
+// checkListenAddress refuses addresses that wshd, which may run as root, must not
+// listen on for account: privileged ports unless the account is root, and other
+// addresses than loopback unless gateway ports are enabled.
+func (r *remoteForwardSession) checkListenAddress(address string, account *wampshell.Account) error {
+	host, service, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	port, err := net.LookupPort("tcp", service)
+	if err != nil {
+		return err
+	}
+	if port != 0 && port < 1024 && account.UID != 0 {
+		return fmt.Errorf("only root may forward privileged port %d", port)
+	}
+
+	if r.gatewayPorts || host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+
+	return fmt.Errorf("remote forwards may only listen on loopback addresses")
+}
+
+func (r *remoteForwardSession) closeListener(key forwardKey) {
+	r.Lock()
+	listener, ok := r.listeners[key]
+	delete(r.listeners, key)
+	r.Unlock()
+
+	if ok {
+		listener.close()
+		log.Printf("stopped remote forward %d of caller %d", key.id, key.caller)
+	}
+}
+
+// isNoSuchProcedure reports whether err shows that the callback of a caller is no
+// longer registered.
+func isNoSuchProcedure(err error) bool {
+	var wampErr *xconn.Error
+	return errors.As(err, &wampErr) && wampErr.URI == "wamp.error.no_such_procedure"
+}
+
+func (r *remoteForwardSession) accept(key forwardKey, listener *remoteListener, keys *wampshell.KeyPair) {
+	procedure := fmt.Sprintf("%s.%d", wampshell.ProcedureForwardConnect, key.caller)
+	for {
+		conn, err := listener.listener.Accept()
+		if err != nil {
+			r.closeListener(key)
+			return
+		}
+
+		go func() {
+			request, err := json.Marshal(&wampshell.ForwardConnection{
+				Listener: key.id,
+				Origin:   conn.RemoteAddr().String(),
+			})
+			if err != nil {
+				_ = conn.Close()
+				return
+			}
+
+			err = wampshell.ForwardConn(r.session, procedure, keys, r.nextID.Add(1), request, conn)
+			if isNoSuchProcedure(err) {
+				r.closeListener(key)
+			} else if err != nil {
+				log.Printf("Remote forward %d of caller %d failed: %v", key.id, key.caller, err)
+			}
+		}()
+	}
+}
+
+// probe closes the listener once the callback of its caller is gone, even if no
+// connection arrives that would notice it.
+func (r *remoteForwardSession) probe(key forwardKey, listener *remoteListener) {
+	procedure := fmt.Sprintf("%s.%d", wampshell.ProcedureForwardConnect, key.caller)
+	ticker := time.NewTicker(forwardProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-listener.closed:
+			return
+		case <-ticker.C:
+			if response := r.session.Call(procedure).Do(); isNoSuchProcedure(response.Err) {
+				r.closeListener(key)
+				return
+			}
+		}
+	}
+}
+
+// handleListen opens the listener of a remote forward. The call stays open for the
+// lifetime of the forward, the caller ends it to stop listening.
+func (r *remoteForwardSession) handleListen(e *wampshell.EncryptionManager) xconn.InvocationHandler {
+	return requirePortForwarding(e, func(_ context.Context, inv *xconn.Invocation) *xconn.InvocationResult {
+		caller := inv.Caller()
+		keys, ok := e.Key(caller)
+		if !ok {
+			return xconn.NewInvocationError("wamp.error.unavailable", "no encryption key for caller")
+		}
+
+		message, err := decryptPayload(inv, keys.Receive)
+		if err != nil {
+			return xconn.NewInvocationError("wamp.error.internal_error", err.Error())
+		}
+
+		id, body, err := wampshell.ParseStreamMessage(message)
+		if err != nil {
+			return xconn.NewInvocationError("wamp.error.invalid_argument", err.Error())
+		}
+		key := forwardKey{caller: caller, id: id}
+
+		r.Lock()
+		_, ok = r.listeners[key]
+		r.Unlock()
+
+		if ok {
+			if inv.Progress() {
+				return xconn.NewInvocationError(xconn.ErrNoResult)
+			}
+
+			r.closeListener(key)
+			return xconn.NewInvocationResult()
+		}
+
+		if !inv.Progress() {
+			return xconn.NewInvocationError("wamp.error.invalid_argument", "unknown remote forward")
+		}
+
+		var request wampshell.ForwardRequest
+		if err = json.Unmarshal(body, &request); err != nil {
+			return xconn.NewInvocationError("wamp.error.invalid_argument", err.Error())
+		}
+
+		account, ok := e.Account(caller)
+		if !ok {
+			return xconn.NewInvocationError("wamp.error.unavailable", "no account for caller")
+		}
+		if err = r.checkListenAddress(request.Address, account); err != nil {
+			return xconn.NewInvocationError("wamp.error.not_authorized", err.Error())
+		}
+
+		listener, err := net.Listen("tcp", request.Address)
+		if err != nil {
+			return xconn.NewInvocationError("io.xconn.error", err.Error())
+		}
+		remote := &remoteListener{listener: listener, closed: make(chan struct{})}
+
+		// the caller learns the actual address, which matters if it asked for port 0
+		reply, err := json.Marshal(&wampshell.ForwardRequest{Address: listener.Addr().String()})
+		if err == nil {
+			var payload []byte
+			if payload, err = wampshell.EncryptPayload(reply, keys.Send); err == nil {
+				err = inv.SendProgress([]any{payload}, nil)
+			}
+		}
+		if err != nil {
+			_ = listener.Close()
+			return xconn.NewInvocationError("wamp.error.internal_error", err.Error())
+		}
+
+		r.Lock()
+		r.listeners[key] = remote
+		r.Unlock()
+		log.Printf("remote forward %d of caller %d listening on %s", id, caller, listener.Addr())
+
+		go r.accept(key, remote, keys)
+		go r.probe(key, remote)
+		return xconn.NewInvocationError(xconn.ErrNoResult)
+	})
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/xconnio/wampshell"
+	"github.com/xconnio/xconn-go"
+)
+
+type fsOperation func(account *wampshell.Account, request *wampshell.FSRequest) (any, error)
+
+// handleFS decrypts the FSRequest of a wampshell.fs procedure, checks that the key
+// may use it and runs op with the filesystem credentials of the caller's account.
+func handleFS(e *wampshell.EncryptionManager, allowed func(*wampshell.KeyOptions) bool,
+	op fsOperation) xconn.InvocationHandler {
+	return func(_ context.Context, inv *xconn.Invocation) *xconn.InvocationResult {
+		key, ok := e.Key(inv.Caller())
+		if !ok {
+			return xconn.NewInvocationError("wamp.error.unavailable", "no encryption key for caller")
+		}
+
+		account, ok := e.Account(inv.Caller())
+		if !ok {
+			return xconn.NewInvocationError("wamp.error.unavailable", "no account for caller")
+		}
+
+		options, err := e.KeyOptions(inv.Caller())
+		if err != nil {
+			return xconn.NewInvocationError("wamp.error.not_authorized", err.Error())
+		}
+		if !allowed(options) {
+			return xconn.NewInvocationError("wamp.error.not_authorized", "operation is disabled for this key")
+		}
+
+		payload, err := decryptPayload(inv, key.Receive)
+		if err != nil {
+			return xconn.NewInvocationError("wamp.error.internal_error", err.Error())
+		}
+
+		var request wampshell.FSRequest
+		if err = json.Unmarshal(payload, &request); err != nil {
+			return xconn.NewInvocationError("wamp.error.invalid_argument", err.Error())
+		}
+
+		var result any
+		err = account.Do(func() error {
+			result, err = op(account, &request)
+			return err
+		})
+		if errors.Is(err, fs.ErrNotExist) {
+			return xconn.NewInvocationError(wampshell.ErrorNotFound, err.Error())
+		} else if err != nil {
+			return xconn.NewInvocationError("wamp.error.internal_error", err.Error())
+		}
+
+		resultJSON, err := json.Marshal(result)
+		if err != nil {
+			return xconn.NewInvocationError("wamp.error.internal_error", err.Error())
+		}
+
+		encrypted, err := wampshell.EncryptPayload(resultJSON, key.Send)
+		if err != nil {
+			return xconn.NewInvocationError("wamp.error.internal_error", err.Error())
+		}
+
+		return xconn.NewInvocationResult(encrypted)
+	}
+}
+
+// fsWalk lists the tree below request.Path without following symbolic links.
+func fsWalk(account *wampshell.Account, request *wampshell.FSRequest) (any, error) {
+	return wampshell.WalkTree(account.Path(request.Path))
+}
+
+// fsStat describes request.Path itself, symbolic links are not followed.
+func fsStat(account *wampshell.Account, request *wampshell.FSRequest) (any, error) {
+	path := account.Path(request.Path)
+	stat := os.Lstat
+	if request.Follow {
+		stat = os.Stat
+	}
+
+	info, err := stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return wampshell.NewFileEntry(path, request.Path, info)
+}
+
+// fsList describes the entries of the directory request.Path, sorted by name.
+func fsList(account *wampshell.Account, request *wampshell.FSRequest) (any, error) {
+	dir := account.Path(request.Path)
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]wampshell.FileEntry, 0, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		info, err := dirEntry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			// removed since the directory was read
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		entry, err := wampshell.NewFileEntry(filepath.Join(dir, dirEntry.Name()), dirEntry.Name(), info)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, *entry)
+	}
+
+	return entries, nil
+}
+
+// fsGlob expands the pattern in request.Path. Matches of a relative pattern are
+// returned relative to the home directory, like the pattern itself.
+func fsGlob(account *wampshell.Account, request *wampshell.FSRequest) (any, error) {
+	matches, err := filepath.Glob(account.Path(request.Path))
+	if err != nil {
+		return nil, err
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("no matches for %s: %w", request.Path, fs.ErrNotExist)
+	}
+
+	if !filepath.IsAbs(request.Path) {
+		for i, match := range matches {
+			rel, err := filepath.Rel(account.HomeDir, match)
+			if err != nil {
+				return nil, err
+			}
+			matches[i] = filepath.ToSlash(rel)
+		}
+	}
+
+	return matches, nil
+}
+
+// allowsTransfer permits read-only metadata queries to keys that may transfer files
+// in either direction.
+func allowsTransfer(options *wampshell.KeyOptions) bool {
+	return options.AllowsUpload() || options.AllowsDownload()
+}
+
+func fsMkdir(account *wampshell.Account, request *wampshell.FSRequest) (any, error) {
+	mode := request.Mode.Perm()
+	if mode == 0 {
+		mode = 0700
+	}
+
+	path := account.Path(request.Path)
+	mkdir := os.Mkdir
+	if request.Recursive {
+		mkdir = os.MkdirAll
+	}
+	if err := mkdir(path, mode); err != nil {
+		return nil, err
+	}
+
+	if request.Metadata != nil {
+		return nil, request.Metadata.Apply(path)
+	}
+
+	return nil, nil
+}
+
+// fsRemove deletes request.Path, directories must be empty unless the request is
+// recursive.
+func fsRemove(account *wampshell.Account, request *wampshell.FSRequest) (any, error) {
+	if err := requirePath(request); err != nil {
+		return nil, err
+	}
+
+	path := account.Path(request.Path)
+	if request.Recursive {
+		// RemoveAll does not report a missing path, which remove is expected to
+		if _, err := os.Lstat(path); err != nil {
+			return nil, err
+		}
+		return nil, os.RemoveAll(path)
+	}
+
+	return nil, os.Remove(path)
+}
+
+func fsRename(account *wampshell.Account, request *wampshell.FSRequest) (any, error) {
+	if err := requirePath(request); err != nil {
+		return nil, err
+	}
+	if request.Target == "" {
+		return nil, fmt.Errorf("target is required")
+	}
+
+	return nil, os.Rename(account.Path(request.Path), account.Path(request.Target))
+}
+
+func fsChmod(account *wampshell.Account, request *wampshell.FSRequest) (any, error) {
+	if err := requirePath(request); err != nil {
+		return nil, err
+	}
+
+	return nil, os.Chmod(account.Path(request.Path), request.Mode.Perm())
+}
+
+// requirePath refuses requests without a path, which would otherwise act on the
+// home directory.
+func requirePath(request *wampshell.FSRequest) error {
+	if request.Path == "" {
+		return fmt.Errorf("path is required")
+	}
+
+	return nil
+}
+
+// fsSymlink creates a symbolic link at request.Path, replacing an existing file.
+func fsSymlink(account *wampshell.Account, request *wampshell.FSRequest) (any, error) {
+	path := account.Path(request.Path)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return nil, os.Symlink(request.Target, path)
+}
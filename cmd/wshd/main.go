@@ -1,16 +1,22 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"log"
+	"net"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
 
 	"github.com/creack/pty"
 
@@ -29,254 +35,624 @@ const (
 	procedureExec            = "wampshell.shell.exec"
 	procedureFileUpload      = "wampshell.shell.upload"
 	procedureFileDownload    = "wampshell.shell.download"
+	procedureFSWalk          = "wampshell.fs.walk"
+	procedureFSStat          = "wampshell.fs.stat"
+	procedureFSList          = "wampshell.fs.list"
+	procedureFSGlob          = "wampshell.fs.glob"
+	procedureFSMkdir         = "wampshell.fs.mkdir"
+	procedureFSSymlink       = "wampshell.fs.symlink"
+	procedureFSRemove        = "wampshell.fs.remove"
+	procedureFSRename        = "wampshell.fs.rename"
+	procedureFSChmod         = "wampshell.fs.chmod"
+	procedureSyncSignature   = "wampshell.sync.signature"
+	procedureSyncDelta       = "wampshell.sync.delta"
+	procedureSyncPatch       = "wampshell.sync.patch"
+	procedureForward         = "wampshell.forward.dial"
+	procedureForwardListen   = "wampshell.forward.listen"
 	procedureWebRTCOffer     = "wampshell.webrtc.offer"
 	topicOffererOnCandidate  = "wampshell.webrtc.offerer.on_candidate"
 	topicAnswererOnCandidate = "wampshell.webrtc.answerer.on_candidate"
 )
 
-type interactiveShellSession struct {
-	ptmx map[uint64]*os.File
-	sync.Mutex
+func decryptPayload(inv *xconn.Invocation, receiveKey []byte) ([]byte, error) {
+	payload, err := inv.ArgBytes(0)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) < 12 {
+		return nil, fmt.Errorf("payload too short")
+	}
+
+	return berncrypt.DecryptChaCha20Poly1305(payload[12:], payload[:12], receiveKey)
 }
 
-func newInteractiveShellSession() *interactiveShellSession {
-	return &interactiveShellSession{
-		ptmx: make(map[uint64]*os.File),
-	}
+// streamKey identifies a progressive call of a caller, the id is chosen by the
+// caller, see wampshell.NewStreamMessage.
+type streamKey struct {
+	caller uint64
+	id     uint64
 }
 
-func (p *interactiveShellSession) startPtySession(inv *xconn.Invocation, sendKey []byte) (*os.File, error) {
-	cmd := exec.Command("bash")
-	ptmx, err := pty.Start(cmd)
+// decryptStreamMessage decrypts the message of inv and returns the stream it belongs
+// to with its body.
+func decryptStreamMessage(inv *xconn.Invocation, receiveKey []byte) (streamKey, []byte, error) {
+	message, err := decryptPayload(inv, receiveKey)
 	if err != nil {
-		return nil, fmt.Errorf("failed to start PTY: %w", err)
+		return streamKey{}, nil, err
 	}
-	p.Lock()
-	p.ptmx[inv.Caller()] = ptmx
-	p.Unlock()
 
-	go p.startOutputReader(inv, ptmx, sendKey)
+	id, body, err := wampshell.ParseStreamMessage(message)
+	if err != nil {
+		return streamKey{}, nil, err
+	}
 
-	return ptmx, nil
+	return streamKey{caller: inv.Caller(), id: id}, body, nil
 }
 
-func (p *interactiveShellSession) startOutputReader(inv *xconn.Invocation, ptmx *os.File, sendKey []byte) {
-	caller := inv.Caller()
-	defer func() {
-		p.Lock()
-		delete(p.ptmx, caller)
-		p.Unlock()
-		if err := ptmx.Close(); err != nil {
-			log.Printf("Error closing PTY for caller %d: %v", caller, err)
-		}
-	}()
+// isAbort reports whether the final message of a stream aborts it, which a final
+// message with a body does.
+func isAbort(inv *xconn.Invocation, body []byte) bool {
+	return !inv.Progress() && len(body) > 0
+}
+
+type outputSender struct {
+	inv     *xconn.Invocation
+	sendKey []byte
+	sync.Mutex
+}
+
+func (o *outputSender) send(stream byte, data []byte) error {
+	message := make([]byte, 1+len(data))
+	message[0] = stream
+	copy(message[1:], data)
+
+	ciphertext, nonce, err := berncrypt.EncryptChaCha20Poly1305(message, o.sendKey)
+	if err != nil {
+		return err
+	}
+
+	o.Lock()
+	defer o.Unlock()
+	return o.inv.SendProgress([]any{append(nonce, ciphertext...)}, nil)
+}
+
+func (o *outputSender) copyFrom(stream byte, reader io.Reader) error {
 	buf := make([]byte, 4096)
 	for {
-		n, err := ptmx.Read(buf)
+		n, err := reader.Read(buf)
 		if n > 0 {
-			ciphertext, nonce, errEnc := berncrypt.EncryptChaCha20Poly1305(buf[:n], sendKey)
-			if errEnc != nil {
-				log.Printf("Encryption failed in shell output for caller %d: %v", caller, errEnc)
-				return
+			if errSend := o.send(stream, buf[:n]); errSend != nil {
+				return errSend
 			}
-			payload := append(nonce, ciphertext...)
-			_ = inv.SendProgress([]any{payload}, nil)
 		}
 		if err != nil {
-			_ = inv.SendProgress(nil, nil)
-			return
+			return nil
+		}
+	}
+}
+
+type runningCommand struct {
+	stdin   io.WriteCloser
+	pty     bool
+	process *os.Process
+	done    chan struct{}
+	status  *wampshell.ExitStatus
+}
+
+// closeStdin signals end of input to the command. A PTY has no separate input
+// side that could be closed, so EOF is sent as the terminal EOF character instead.
+func (r *runningCommand) closeStdin() {
+	if r.pty {
+		_, _ = r.stdin.Write([]byte{0x04})
+		return
+	}
+	_ = r.stdin.Close()
+}
+
+// kill ends a command that nobody sends input to or receives output from anymore.
+func (r *runningCommand) kill() {
+	_ = r.process.Kill()
+	_ = r.stdin.Close()
+}
+
+type commandSession struct {
+	commands map[streamKey]*runningCommand
+	sync.Mutex
+}
+
+func newCommandSession() *commandSession {
+	return &commandSession{
+		commands: make(map[streamKey]*runningCommand),
+	}
+}
+
+// forget kills the commands of a caller that left.
+func (c *commandSession) forget(caller uint64) {
+	c.Lock()
+	var commands []*runningCommand
+	for stream, running := range c.commands {
+		if stream.caller == caller {
+			commands = append(commands, running)
+			delete(c.commands, stream)
+		}
+	}
+	c.Unlock()
+
+	for _, running := range commands {
+		running.kill()
+	}
+}
+
+func startCommand(inv *xconn.Invocation, account *wampshell.Account, options *wampshell.KeyOptions,
+	sendKey []byte, request *wampshell.ExecRequest) (*runningCommand, error) {
+	sender := &outputSender{inv: inv, sendKey: sendKey}
+
+	if !options.AllowsPTY() {
+		request.PTY = false
+	}
+	running := &runningCommand{pty: request.PTY, done: make(chan struct{})}
+
+	c, err := buildCommand(account, options, request)
+	if err != nil {
+		return nil, err
+	}
+
+	var copyOutput func()
+	if request.PTY {
+		wampshell.SetTerm(c, request.Term)
+		ptmx, err := pty.Start(c)
+		if err != nil {
+			return nil, err
+		}
+		running.stdin = ptmx
+		running.process = c.Process
+
+		copyOutput = func() {
+			defer func() { _ = ptmx.Close() }()
+			if err := sender.copyFrom(wampshell.StreamStdout, ptmx); err != nil {
+				log.Printf("Failed to send command output for caller %d: %v", inv.Caller(), err)
+				_ = c.Process.Kill()
+			}
+		}
+	} else {
+		stdin, err := c.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		stdout, err := c.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		stderr, err := c.StderrPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err = c.Start(); err != nil {
+			return nil, err
+		}
+		running.stdin = stdin
+		running.process = c.Process
+
+		copyOutput = func() {
+			var wg sync.WaitGroup
+			for stream, reader := range map[byte]io.Reader{wampshell.StreamStdout: stdout, wampshell.StreamStderr: stderr} {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if err := sender.copyFrom(stream, reader); err != nil {
+						log.Printf("Failed to send command output for caller %d: %v", inv.Caller(), err)
+						_ = c.Process.Kill()
+					}
+				}()
+			}
+			wg.Wait()
 		}
 	}
+
+	go func() {
+		copyOutput()
+
+		// the exit status is reported in ProcessState even when Wait returns an ExitError
+		_ = c.Wait()
+		running.status = exitStatus(c.ProcessState)
+
+		// an empty progress tells the caller that the command has exited, so it can stop sending input
+		sender.Lock()
+		_ = inv.SendProgress(nil, nil)
+		sender.Unlock()
+		close(running.done)
+	}()
+
+	return running, nil
 }
 
-func (p *interactiveShellSession) handleShell(e *wampshell.EncryptionManager) func(_ context.Context,
+func buildCommand(account *wampshell.Account, options *wampshell.KeyOptions,
+	request *wampshell.ExecRequest) (*exec.Cmd, error) {
+	if options != nil && options.Command != "" {
+		// like SSH_ORIGINAL_COMMAND, the forced command can inspect what was asked for
+		cmd := account.Command(account.Shell, "-c", options.Command)
+		cmd.Env = append(cmd.Env, "WAMPSHELL_ORIGINAL_COMMAND="+strings.Join(request.Argv, " "))
+		return cmd, nil
+	}
+
+	if len(request.Argv) == 0 {
+		return nil, fmt.Errorf("empty command")
+	}
+
+	if !request.Shell {
+		return account.Command(request.Argv[0], request.Argv[1:]...), nil
+	}
+
+	shellFlag := "-c"
+	if request.PTY {
+		shellFlag = "-ic"
+	}
+	// the shell takes the first argument after the command line as $0
+	args := append([]string{shellFlag, request.Argv[0], filepath.Base(account.Shell)}, request.Argv[1:]...)
+	return account.Command(account.Shell, args...), nil
+}
+
+func exitStatus(state *os.ProcessState) *wampshell.ExitStatus {
+	status := &wampshell.ExitStatus{Code: state.ExitCode()}
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		status.Signal = int(ws.Signal())
+	}
+
+	return status
+}
+
+func (c *commandSession) handleRunCommand(e *wampshell.EncryptionManager) func(_ context.Context,
 	inv *xconn.Invocation) *xconn.InvocationResult {
+	e.OnLeave(c.forget)
+
 	return func(_ context.Context, inv *xconn.Invocation) *xconn.InvocationResult {
 		caller := inv.Caller()
-		key, ok := e.Key(inv.Caller())
+		key, ok := e.Key(caller)
 		if !ok {
 			return xconn.NewInvocationError("wamp.error.unavailable", "unavailable")
 		}
 
-		p.Lock()
-		ptmx, ok := p.ptmx[caller]
-		p.Unlock()
+		account, ok := e.Account(caller)
+		if !ok {
+			return xconn.NewInvocationError("wamp.error.unavailable", "unavailable")
+		}
+
+		stream, body, err := decryptStreamMessage(inv, key.Receive)
+		if err != nil {
+			return xconn.NewInvocationError("wamp.error.invalid_argument", err.Error())
+		}
+
+		c.Lock()
+		running, ok := c.commands[stream]
+		c.Unlock()
 
 		if !ok {
-			_, err := p.startPtySession(inv, key.Send)
+			options, err := e.KeyOptions(caller)
 			if err != nil {
-				return xconn.NewInvocationError("io.xconn.error", err.Error())
+				return xconn.NewInvocationError("wamp.error.not_authorized", err.Error())
 			}
-			return xconn.NewInvocationError(xconn.ErrNoResult)
-		}
 
-		if inv.Progress() {
-			payload, err := inv.ArgBytes(0)
-			if err != nil {
+			var request wampshell.ExecRequest
+			if err = json.Unmarshal(body, &request); err != nil {
 				return xconn.NewInvocationError("wamp.error.invalid_argument", err.Error())
 			}
-			if len(payload) < 12 {
-				return xconn.NewInvocationError("wamp.error.invalid_argument", "payload too short")
-			}
 
-			decrypted, err := berncrypt.DecryptChaCha20Poly1305(payload[12:], payload[:12], key.Receive)
+			running, err = startCommand(inv, account, options, key.Send, &request)
 			if err != nil {
-				p.Lock()
-				if storedPtmx, exists := p.ptmx[caller]; exists {
-					storedPtmx.Close()
-					delete(p.ptmx, caller)
-				}
-				p.Unlock()
-				return xconn.NewInvocationError("io.xconn.error", err.Error())
+				return xconn.NewInvocationError("wamp.error.internal_error", err.Error())
 			}
 
-			_, err = ptmx.Write(decrypted)
-			if err != nil {
-				log.Printf("Failed to write to PTY for caller %d: %v", caller, err)
-				return xconn.NewInvocationError("io.xconn.error", err.Error())
+			if inv.Progress() {
+				c.Lock()
+				c.commands[stream] = running
+				c.Unlock()
+				return xconn.NewInvocationError(xconn.ErrNoResult)
 			}
-			return xconn.NewInvocationError(xconn.ErrNoResult)
+
+			// a non-progressive call carries no input
+			running.closeStdin()
+			return commandResult(running, key.Send)
+		}
+
+		if isAbort(inv, body) {
+			c.Lock()
+			delete(c.commands, stream)
+			c.Unlock()
+			running.kill()
+			return xconn.NewInvocationError("wamp.error.canceled", "command aborted by caller")
+		}
+
+		if len(body) > 0 {
+			// writes fail once the command has exited, the caller learns about that from the exit notification
+			_, _ = running.stdin.Write(body)
 		}
 
-		p.Lock()
-		delete(p.ptmx, caller)
-		p.Unlock()
-		if ok {
-			ptmx.Close()
+		if inv.Progress() {
+			return xconn.NewInvocationError(xconn.ErrNoResult)
 		}
 
-		return xconn.NewInvocationResult()
+		running.closeStdin()
+
+		c.Lock()
+		delete(c.commands, stream)
+		c.Unlock()
+
+		return commandResult(running, key.Send)
 	}
 }
 
-func runCommand(cmd string, args ...string) ([]byte, error) {
-	fullCmd := cmd
-	if len(args) > 0 {
-		fullCmd += " " + strings.Join(args, " ")
+func commandResult(running *runningCommand, sendKey []byte) *xconn.InvocationResult {
+	<-running.done
+
+	statusJSON, err := json.Marshal(running.status)
+	if err != nil {
+		return xconn.NewInvocationError("wamp.error.internal_error", err.Error())
 	}
-	c := exec.Command("bash", "-ic", fullCmd)
-	ptmx, err := pty.Start(c)
+
+	ciphertext, nonce, err := berncrypt.EncryptChaCha20Poly1305(statusJSON, sendKey)
 	if err != nil {
-		return nil, err
+		log.Printf("Encryption failed in commandResult: %v", err)
+		return xconn.NewInvocationError("wamp.error.internal_error", err.Error())
 	}
-	defer func() { _ = ptmx.Close() }()
 
-	var stdout bytes.Buffer
-	_, _ = stdout.ReadFrom(ptmx)
+	return xconn.NewInvocationResult(append(nonce, ciphertext...))
+}
+
+// upload is an upload in progress, the metadata is applied once the file is
+// complete.
+type upload struct {
+	file     *os.File
+	hash     hash.Hash
+	account  *wampshell.Account
+	metadata *wampshell.FileMetadata
+}
+
+type uploadSession struct {
+	uploads map[streamKey]*upload
+	sync.Mutex
+}
 
-	return stdout.Bytes(), nil
+func newUploadSession() *uploadSession {
+	return &uploadSession{
+		uploads: make(map[streamKey]*upload),
+	}
 }
 
-func handleRunCommand(e *wampshell.EncryptionManager) func(_ context.Context,
+func (u *uploadSession) closeFile(stream streamKey) {
+	u.Lock()
+	current, ok := u.uploads[stream]
+	delete(u.uploads, stream)
+	u.Unlock()
+
+	if ok {
+		_ = current.file.Close()
+	}
+}
+
+// forget closes the files of the uploads of a caller that left.
+func (u *uploadSession) forget(caller uint64) {
+	u.Lock()
+	var uploads []*upload
+	for stream, current := range u.uploads {
+		if stream.caller == caller {
+			uploads = append(uploads, current)
+			delete(u.uploads, stream)
+		}
+	}
+	u.Unlock()
+
+	for _, current := range uploads {
+		_ = current.file.Close()
+	}
+}
+
+func (u *uploadSession) handleFileUpload(e *wampshell.EncryptionManager) func(_ context.Context,
 	inv *xconn.Invocation) *xconn.InvocationResult {
+	e.OnLeave(u.forget)
+
 	return func(_ context.Context, inv *xconn.Invocation) *xconn.InvocationResult {
-		encryptedPayload, err := inv.ArgBytes(0)
+		caller := inv.Caller()
+		key, ok := e.Key(caller)
+		if !ok {
+			return xconn.NewInvocationError("wamp.error.unavailable", "no encryption key for caller")
+		}
+
+		stream, body, err := decryptStreamMessage(inv, key.Receive)
 		if err != nil {
 			return xconn.NewInvocationError("wamp.error.invalid_argument", err.Error())
 		}
 
-		key, ok := e.Key(inv.Caller())
+		u.Lock()
+		current, ok := u.uploads[stream]
+		u.Unlock()
+
 		if !ok {
-			return xconn.NewInvocationError("wamp.error.unavailable", "unavailable")
-		}
+			log.Printf("handleFileUpload called for caller: %d", caller)
 
-		decryptedPayload, err := berncrypt.DecryptChaCha20Poly1305(encryptedPayload[12:], encryptedPayload[:12], key.Receive)
-		if err != nil {
-			return xconn.NewInvocationError("wamp.error.internal_error", err.Error())
-		}
+			account, ok := e.Account(caller)
+			if !ok {
+				return xconn.NewInvocationError("wamp.error.unavailable", "no account for caller")
+			}
+
+			options, err := e.KeyOptions(caller)
+			if err != nil {
+				return xconn.NewInvocationError("wamp.error.not_authorized", err.Error())
+			}
+			if !options.AllowsUpload() {
+				return xconn.NewInvocationError("wamp.error.not_authorized", "upload is disabled for this key")
+			}
 
-		s := string(decryptedPayload)
-		newStrs := strings.Split(s, " ")
+			var request wampshell.TransferRequest
+			if err = json.Unmarshal(body, &request); err != nil {
+				return xconn.NewInvocationError("wamp.error.invalid_argument", err.Error())
+			}
 
-		cmd := newStrs[0]
-		rawArgs := newStrs[1:]
+			flags := os.O_CREATE | os.O_RDWR
+			if request.Offset == 0 {
+				flags |= os.O_TRUNC
+			}
 
-		output, err := runCommand(cmd, rawArgs...)
-		if err != nil {
-			return xconn.NewInvocationError("wamp.error.internal_error", err.Error())
+			var file *os.File
+			err = account.Do(func() error {
+				file, err = os.OpenFile(account.Path(request.Path), flags, 0600)
+				return err
+			})
+			if err != nil {
+				return xconn.NewInvocationError("wamp.error.internal_error", err.Error())
+			}
+
+			// the data already received is hashed and anything after the offset is
+			// discarded, leaving the file positioned where the upload resumes
+			hasher, err := wampshell.HashPrefix(file, request.Offset)
+			if err == nil {
+				err = file.Truncate(request.Offset)
+			}
+			if err != nil {
+				_ = file.Close()
+				return xconn.NewInvocationError("wamp.error.invalid_argument", err.Error())
+			}
+
+			current = &upload{file: file, hash: hasher, account: account, metadata: request.Metadata}
+			u.Lock()
+			u.uploads[stream] = current
+			u.Unlock()
+		} else if isAbort(inv, body) {
+			// the file is kept as far as it was received, a later upload may resume it
+			u.closeFile(stream)
+			return xconn.NewInvocationError("wamp.error.canceled", "upload aborted by caller")
+		} else if len(body) > 0 {
+			if _, err = current.file.Write(body); err != nil {
+				u.closeFile(stream)
+				return xconn.NewInvocationError("wamp.error.internal_error", err.Error())
+			}
+			current.hash.Write(body)
 		}
 
-		ciphertext, nonce, err := berncrypt.EncryptChaCha20Poly1305(output, key.Send)
+		if inv.Progress() {
+			return xconn.NewInvocationError(xconn.ErrNoResult)
+		}
+
+		info, err := current.file.Stat()
+		u.closeFile(stream)
 		if err != nil {
-			log.Printf("Encryption failed in runCommand: %v", err)
 			return xconn.NewInvocationError("wamp.error.internal_error", err.Error())
 		}
 
-		return xconn.NewInvocationResult(append(nonce, ciphertext...))
+		if current.metadata != nil {
+			err = current.account.Do(func() error {
+				return current.metadata.Apply(current.file.Name())
+			})
+			if err != nil {
+				return xconn.NewInvocationError("wamp.error.internal_error", err.Error())
+			}
+		}
+
+		log.Printf("file uploaded: %s (%d bytes)", current.file.Name(), info.Size())
+		return transferResult(&wampshell.TransferResult{
+			Size:   info.Size(),
+			SHA256: hex.EncodeToString(current.hash.Sum(nil)),
+		}, key.Send)
 	}
 }
 
-func handleFileUpload(e *wampshell.EncryptionManager) func(_ context.Context,
+func handleFileDownload(e *wampshell.EncryptionManager) func(_ context.Context,
 	inv *xconn.Invocation) *xconn.InvocationResult {
 	return func(_ context.Context, inv *xconn.Invocation) *xconn.InvocationResult {
-		log.Printf("handleFileUpload called for caller: %d", inv.Caller())
+		log.Printf("handleFileDownload called for caller: %d", inv.Caller())
 
-		if len(inv.Args()) < 2 {
-			return xconn.NewInvocationError("wamp.error.invalid_argument", "expected filename + encrypted data")
+		key, ok := e.Key(inv.Caller())
+		if !ok {
+			return xconn.NewInvocationError("wamp.error.unavailable", "no encryption key for caller")
 		}
 
-		filename, err := inv.ArgString(0)
-		if err != nil {
-			return xconn.NewInvocationError("wamp.error.invalid_argument", err.Error())
+		account, ok := e.Account(inv.Caller())
+		if !ok {
+			return xconn.NewInvocationError("wamp.error.unavailable", "no account for caller")
 		}
 
-		payload, err := inv.ArgBytes(1)
+		options, err := e.KeyOptions(inv.Caller())
 		if err != nil {
-			return xconn.NewInvocationError("wamp.error.invalid_argument",
-				fmt.Sprintf("file content must be []byte, got %s", err.Error()))
+			return xconn.NewInvocationError("wamp.error.not_authorized", err.Error())
 		}
-
-		key, ok := e.Key(inv.Caller())
-		if !ok {
-			return xconn.NewInvocationError("wamp.error.unavailable", "no encryption key for caller")
+		if !options.AllowsDownload() {
+			return xconn.NewInvocationError("wamp.error.not_authorized", "download is disabled for this key")
 		}
 
-		decryptedData, err := berncrypt.DecryptChaCha20Poly1305(payload[12:], payload[:12], key.Receive)
+		header, err := decryptPayload(inv, key.Receive)
 		if err != nil {
 			return xconn.NewInvocationError("wamp.error.internal_error", err.Error())
 		}
 
-		if err := os.WriteFile(filepath.Clean(filename), decryptedData, 0600); err != nil {
-			return xconn.NewInvocationError("wamp.error.internal_error", err.Error())
+		var request wampshell.TransferRequest
+		if err = json.Unmarshal(header, &request); err != nil {
+			return xconn.NewInvocationError("wamp.error.invalid_argument", err.Error())
 		}
 
-		msg := fmt.Sprintf("file uploaded: %s (%d bytes)", filename, len(decryptedData))
-		ciphertext, nonce, err := berncrypt.EncryptChaCha20Poly1305([]byte(msg), key.Send)
+		var file *os.File
+		err = account.Do(func() error {
+			file, err = os.Open(account.Path(request.Path))
+			return err
+		})
 		if err != nil {
 			return xconn.NewInvocationError("wamp.error.internal_error", err.Error())
 		}
+		defer func() { _ = file.Close() }()
 
-		return xconn.NewInvocationResult(append(nonce, ciphertext...))
-	}
-}
-
-func handleFileDownload(e *wampshell.EncryptionManager) func(_ context.Context,
-	inv *xconn.Invocation) *xconn.InvocationResult {
-	return func(_ context.Context, inv *xconn.Invocation) *xconn.InvocationResult {
-		log.Printf("handleFileDownload called for caller: %d", inv.Caller())
+		// taken before reading, which would update the access time
+		info, err := file.Stat()
+		if err != nil {
+			return xconn.NewInvocationError("wamp.error.internal_error", err.Error())
+		}
+		metadata := wampshell.NewFileMetadata(info)
 
-		filename, err := inv.ArgString(0)
+		hasher, err := wampshell.HashPrefix(file, request.Offset)
 		if err != nil {
 			return xconn.NewInvocationError("wamp.error.invalid_argument", err.Error())
 		}
 
-		key, ok := e.Key(inv.Caller())
-		if !ok {
-			return xconn.NewInvocationError("wamp.error.unavailable", "no encryption key for caller")
+		size := request.Offset
+		buf := make([]byte, wampshell.TransferChunkSize)
+		for {
+			n, err := file.Read(buf)
+			if n > 0 {
+				payload, errEnc := wampshell.EncryptPayload(buf[:n], key.Send)
+				if errEnc != nil {
+					return xconn.NewInvocationError("wamp.error.internal_error", errEnc.Error())
+				}
+				if errSend := inv.SendProgress([]any{payload}, nil); errSend != nil {
+					return xconn.NewInvocationError("wamp.error.internal_error", errSend.Error())
+				}
+				hasher.Write(buf[:n])
+				size += int64(n)
+			}
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return xconn.NewInvocationError("wamp.error.internal_error", err.Error())
+			}
 		}
 
-		decryptedData, err := os.ReadFile(filepath.Clean(filename))
-		if err != nil {
-			return xconn.NewInvocationError("wamp.error.internal_error", err.Error())
-		}
+		return transferResult(&wampshell.TransferResult{
+			Size:     size,
+			SHA256:   hex.EncodeToString(hasher.Sum(nil)),
+			Metadata: metadata,
+		}, key.Send)
+	}
+}
 
-		ciphertext, nonce, err := berncrypt.EncryptChaCha20Poly1305(decryptedData, key.Send)
-		if err != nil {
-			return xconn.NewInvocationError("wamp.error.internal_error", err.Error())
-		}
+func transferResult(result *wampshell.TransferResult, sendKey []byte) *xconn.InvocationResult {
+	resultJSON, err := json.Marshal(result)
+	if err != nil {
+		return xconn.NewInvocationError("wamp.error.internal_error", err.Error())
+	}
 
-		return xconn.NewInvocationResult(append(nonce, ciphertext...))
+	payload, err := wampshell.EncryptPayload(resultJSON, sendKey)
+	if err != nil {
+		return xconn.NewInvocationError("wamp.error.internal_error", err.Error())
 	}
+
+	return xconn.NewInvocationResult(payload)
 }
 
 func addRealm(router *xconn.Router, realm string) {
@@ -329,7 +705,12 @@ func main() {
 		}
 	})
 
-	encryption := wampshell.NewEncryptionManager(router)
+	hostKey, err := wampshell.ParsePrivateKey(privateKey)
+	if err != nil {
+		log.Fatalf("Error parsing private key: %s", err)
+	}
+
+	encryption := wampshell.NewEncryptionManager(router, keyStore, hostKey)
 	if err = encryption.Setup(); err != nil {
 		log.Fatal(err)
 	}
@@ -339,25 +720,30 @@ func main() {
 		handler xconn.InvocationHandler
 	}{
 		{procedureInteractive, newInteractiveShellSession().handleShell(encryption)},
-		{procedureExec, handleRunCommand(encryption)},
-		{procedureFileUpload, handleFileUpload(encryption)},
+		{procedureExec, newCommandSession().handleRunCommand(encryption)},
+		{procedureFileUpload, newUploadSession().handleFileUpload(encryption)},
 		{procedureFileDownload, handleFileDownload(encryption)},
+		{procedureFSWalk, handleFS(encryption, (*wampshell.KeyOptions).AllowsDownload, fsWalk)},
+		{procedureFSStat, handleFS(encryption, allowsTransfer, fsStat)},
+		{procedureFSList, handleFS(encryption, allowsTransfer, fsList)},
+		{procedureFSGlob, handleFS(encryption, allowsTransfer, fsGlob)},
+		{procedureFSMkdir, handleFS(encryption, (*wampshell.KeyOptions).AllowsUpload, fsMkdir)},
+		{procedureFSSymlink, handleFS(encryption, (*wampshell.KeyOptions).AllowsUpload, fsSymlink)},
+		{procedureFSRemove, handleFS(encryption, (*wampshell.KeyOptions).AllowsUpload, fsRemove)},
+		{procedureFSRename, handleFS(encryption, (*wampshell.KeyOptions).AllowsUpload, fsRename)},
+		{procedureFSChmod, handleFS(encryption, (*wampshell.KeyOptions).AllowsUpload, fsChmod)},
+		{procedureSyncSignature, handleFS(encryption, (*wampshell.KeyOptions).AllowsUpload, fsSignature)},
+		{procedureSyncDelta, handleSyncDelta(encryption)},
+		{procedureSyncPatch, newPatchSession().handleSyncPatch(encryption)},
+		{procedureForward, handleForward(encryption)},
 	}
 
-	server := xconn.NewServer(router, authenticator, nil)
-	if server == nil {
-		log.Fatal("failed to create server")
-	}
-
-	if err = server.RegisterSpec(wampshell.CapnprotoSerializerSpec); err != nil {
-		log.Fatal(err)
-	}
-
-	closer, err := server.ListenAndServeRawSocket(xconn.NetworkTCP, address)
+	listener, err := net.Listen("tcp", address)
 	if err != nil {
 		log.Fatalf("failed to start server: %v", err)
 	}
-	defer func() { _ = closer.Close() }()
+	defer func() { _ = listener.Close() }()
+	go wampshell.NewRawSocketServer(router, authenticator, encryption.Join, encryption.Leave).Serve(listener)
 
 	session, err := xconn.ConnectInMemory(router, defaultRealm)
 	if err != nil {
@@ -400,6 +786,13 @@ func main() {
 			}
 			log.Printf("Procedure registered: %s", proc.name)
 		}
+
+		// remote forwards call back into the client through the router it is connected to
+		listen := newRemoteForwardSession(sess, loadConfig.GatewayPorts).handleListen(encryption)
+		if registerResponse := sess.Register(procedureForwardListen, listen).Do(); registerResponse.Err != nil {
+			log.Fatalln(registerResponse.Err)
+		}
+		log.Printf("Procedure registered: %s", procedureForwardListen)
 	}
 
 	log.Printf("listening on rs://%s", address)
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/creack/pty"
+
+	"github.com/xconnio/wampshell"
+	"github.com/xconnio/xconn-go"
+)
+
+// shellReplaySize is how much of the recent output of a resumable shell is kept to
+// replay it after a reconnect.
+const shellReplaySize = 64 * 1024
+
+// shellSession is a PTY and the caller its output is sent to. A resumable shell
+// outlives the WAMP session that started it: when its caller is lost, the shell
+// keeps running detached for wampshell.ShellGracePeriod and a new session can
+// attach it again with its token.
+type shellSession struct {
+	ptmx      *os.File
+	uid       uint32
+	token     []byte
+	resumable bool
+
+	// output is the tail of what the shell wrote, written counts all of it
+	output  []byte
+	written uint64
+
+	// inv is nil while the shell is detached
+	inv      *xconn.Invocation
+	stream   streamKey
+	sendKey  []byte
+	lastSeen time.Time
+	exited   bool
+	sync.Mutex
+
+	closeOnce sync.Once
+
+	// sendMu keeps the messages to the caller in order
+	sendMu sync.Mutex
+}
+
+func (s *shellSession) send(inv *xconn.Invocation, sendKey, message []byte) error {
+	payload, err := wampshell.EncryptPayload(message, sendKey)
+	if err != nil {
+		return err
+	}
+
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	return inv.SendProgress([]any{payload}, nil)
+}
+
+// end closes the PTY, which ends the output reader and with it the shell. Only the
+// first call closes it, later ones return nil.
+func (s *shellSession) end() error {
+	var err error
+	s.closeOnce.Do(func() { err = s.ptmx.Close() })
+	return err
+}
+
+// detach stops sending output to inv, unless the shell was attached to another
+// caller in the meantime.
+func (s *shellSession) detach(inv *xconn.Invocation) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.inv == inv && inv != nil {
+		s.inv = nil
+		log.Printf("Shell of caller %d detached", s.stream.caller)
+	}
+}
+
+// write sends output of the shell to the attached caller. Shells that are not
+// resumable were started by clients that predate resuming, which expect the output
+// without a message type. Such a shell can not be attached again, so it ends once
+// its output can not be sent, while a resumable one is detached.
+func (s *shellSession) write(data []byte) {
+	s.Lock()
+	if s.resumable {
+		s.output = append(s.output, data...)
+		if len(s.output) > shellReplaySize {
+			s.output = s.output[len(s.output)-shellReplaySize:]
+		}
+	}
+	s.written += uint64(len(data))
+	inv, sendKey, caller := s.inv, s.sendKey, s.stream.caller
+	s.Unlock()
+
+	if inv == nil {
+		return
+	}
+
+	message := wampshell.NewDataMessage(data)
+	if !s.resumable {
+		message = data
+	}
+
+	if err := s.send(inv, sendKey, message); err != nil {
+		log.Printf("Failed to send shell output to caller %d: %v", caller, err)
+		if s.resumable {
+			s.detach(inv)
+		} else {
+			_ = s.end()
+		}
+	}
+}
+
+// attach makes inv receive the output of the shell. A resumable shell first tells
+// the caller its token and replays the output from offset on, as far as it is still
+// buffered. It returns the stream that was attached before.
+func (s *shellSession) attach(inv *xconn.Invocation, stream streamKey, sendKey []byte, offset uint64) (streamKey,
+	error) {
+	s.Lock()
+	defer s.Unlock()
+
+	previous := s.stream
+	s.inv, s.stream, s.sendKey, s.lastSeen = inv, stream, sendKey, time.Now()
+	if !s.resumable {
+		return previous, nil
+	}
+
+	start := s.written - uint64(len(s.output))
+	offset = min(max(offset, start), s.written)
+
+	err := s.send(inv, sendKey, wampshell.NewSessionMessage(s.token, offset))
+	if replay := s.output[offset-start:]; err == nil && len(replay) > 0 {
+		err = s.send(inv, sendKey, wampshell.NewDataMessage(replay))
+	}
+	if err != nil {
+		s.inv = nil
+	}
+
+	return previous, err
+}
+
+// keepalive answers a keepalive of the attached caller.
+func (s *shellSession) keepalive() {
+	s.Lock()
+	inv, sendKey := s.inv, s.sendKey
+	s.Unlock()
+
+	if inv != nil {
+		if err := s.send(inv, sendKey, wampshell.NewKeepaliveMessage()); err != nil {
+			s.detach(inv)
+		}
+	}
+}
+
+// watch detaches the caller of a resumable shell once its keepalives stop, and ends
+// the shell if it was not resumed within the grace period.
+func (s *shellSession) watch() {
+	ticker := time.NewTicker(wampshell.ShellKeepaliveInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.Lock()
+		if s.exited {
+			s.Unlock()
+			return
+		}
+
+		idle := time.Since(s.lastSeen)
+		if s.inv != nil && idle > wampshell.ShellKeepaliveTimeout {
+			s.inv = nil
+			log.Printf("Shell of caller %d detached after %s without keepalive", s.stream.caller, idle.Round(time.Second))
+		}
+		expired := s.inv == nil && idle > wampshell.ShellGracePeriod
+		s.Unlock()
+
+		if expired {
+			log.Printf("Closing shell of caller %d, it was not resumed in time", s.stream.caller)
+			_ = s.end()
+			return
+		}
+	}
+}
+
+type interactiveShellSession struct {
+	// shells are found by the stream they are attached to, or by their token
+	shells map[streamKey]*shellSession
+	tokens map[string]*shellSession
+	sync.Mutex
+}
+
+func newInteractiveShellSession() *interactiveShellSession {
+	return &interactiveShellSession{
+		shells: make(map[streamKey]*shellSession),
+		tokens: make(map[string]*shellSession),
+	}
+}
+
+func (p *interactiveShellSession) startPtySession(inv *xconn.Invocation, stream streamKey, account *wampshell.Account,
+	options *wampshell.KeyOptions, sendKey []byte, size *pty.Winsize, term string, resumable bool) error {
+	cmd := account.LoginShell()
+	if options != nil && options.Command != "" {
+		cmd = account.Command(account.Shell, "-c", options.Command)
+	}
+	wampshell.SetTerm(cmd, term)
+	ptmx, err := pty.StartWithSize(cmd, size)
+	if err != nil {
+		return fmt.Errorf("failed to start PTY: %w", err)
+	}
+
+	shell := &shellSession{ptmx: ptmx, uid: account.UID, resumable: resumable}
+	if resumable {
+		shell.token = make([]byte, wampshell.ShellTokenSize)
+		if _, err = rand.Read(shell.token); err != nil {
+			_ = ptmx.Close()
+			return fmt.Errorf("failed to create session token: %w", err)
+		}
+	}
+
+	p.Lock()
+	p.shells[stream] = shell
+	if resumable {
+		p.tokens[string(shell.token)] = shell
+	}
+	p.Unlock()
+
+	if _, err = shell.attach(inv, stream, sendKey, 0); err != nil {
+		p.closeShell(shell)
+		return err
+	}
+
+	go p.startOutputReader(shell)
+	if resumable {
+		go shell.watch()
+	}
+
+	return nil
+}
+
+// resume attaches the shell with token to stream, whose caller must be logged in to
+// the same account as the caller that started it.
+func (p *interactiveShellSession) resume(inv *xconn.Invocation, stream streamKey, account *wampshell.Account,
+	sendKey, token []byte, offset uint64, size *pty.Winsize) *xconn.InvocationResult {
+	p.Lock()
+	shell, ok := p.tokens[string(token)]
+	p.Unlock()
+	if !ok || shell.uid != account.UID {
+		return xconn.NewInvocationError(wampshell.ErrorNotFound, "no such shell session")
+	}
+
+	previous, err := shell.attach(inv, stream, sendKey, offset)
+	if err != nil {
+		return xconn.NewInvocationError("io.xconn.error", err.Error())
+	}
+
+	p.Lock()
+	if p.shells[previous] == shell {
+		delete(p.shells, previous)
+	}
+	p.shells[stream] = shell
+	p.Unlock()
+	log.Printf("Shell of caller %d resumed by caller %d", previous.caller, stream.caller)
+
+	if size != nil {
+		if err = pty.Setsize(shell.ptmx, size); err != nil {
+			log.Printf("Failed to resize PTY for caller %d: %v", inv.Caller(), err)
+		}
+	}
+
+	return xconn.NewInvocationError(xconn.ErrNoResult)
+}
+
+func (p *interactiveShellSession) startOutputReader(shell *shellSession) {
+	defer p.closeShell(shell)
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := shell.ptmx.Read(buf)
+		if n > 0 {
+			shell.write(buf[:n])
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// forget releases the shells of a caller that left. A resumable shell is detached
+// right away instead of waiting for its keepalives to time out, other shells end.
+func (p *interactiveShellSession) forget(caller uint64) {
+	p.Lock()
+	var shells []*shellSession
+	for stream, shell := range p.shells {
+		if stream.caller == caller {
+			shells = append(shells, shell)
+			delete(p.shells, stream)
+		}
+	}
+	p.Unlock()
+
+	for _, shell := range shells {
+		if !shell.resumable {
+			_ = shell.end()
+			continue
+		}
+
+		shell.Lock()
+		inv := shell.inv
+		shell.Unlock()
+		shell.detach(inv)
+	}
+}
+
+// closeShell forgets a shell that exited and tells its caller, if one is attached.
+func (p *interactiveShellSession) closeShell(shell *shellSession) {
+	shell.Lock()
+	stream, inv := shell.stream, shell.inv
+	shell.inv, shell.exited = nil, true
+	shell.Unlock()
+
+	p.Lock()
+	if p.shells[stream] == shell {
+		delete(p.shells, stream)
+	}
+	delete(p.tokens, string(shell.token))
+	p.Unlock()
+
+	if err := shell.end(); err != nil {
+		log.Printf("Error closing PTY for caller %d: %v", stream.caller, err)
+	}
+	if inv != nil {
+		shell.sendMu.Lock()
+		_ = inv.SendProgress(nil, nil)
+		shell.sendMu.Unlock()
+	}
+}
+
+// decryptShellMessage returns the stream a message of the shell procedure belongs to
+// with its body. Clients that predate streams send their messages without a stream
+// id, their first message is at most a resize message and their shell is kept as
+// stream 0.
+func (p *interactiveShellSession) decryptShellMessage(inv *xconn.Invocation, receiveKey []byte) (streamKey,
+	[]byte, error) {
+	legacy := streamKey{caller: inv.Caller()}
+	if len(inv.Args()) == 0 {
+		return legacy, nil, nil
+	}
+
+	message, err := decryptPayload(inv, receiveKey)
+	if err != nil {
+		return legacy, nil, err
+	}
+
+	p.Lock()
+	_, ok := p.shells[legacy]
+	p.Unlock()
+	if ok || len(message) < 8 {
+		return legacy, message, nil
+	}
+
+	id, body, err := wampshell.ParseStreamMessage(message)
+	if err != nil {
+		return legacy, nil, err
+	}
+
+	return streamKey{caller: inv.Caller(), id: id}, body, nil
+}
+
+func (p *interactiveShellSession) handleShell(e *wampshell.EncryptionManager) func(_ context.Context,
+	inv *xconn.Invocation) *xconn.InvocationResult {
+	e.OnLeave(p.forget)
+
+	return func(_ context.Context, inv *xconn.Invocation) *xconn.InvocationResult {
+		caller := inv.Caller()
+		key, ok := e.Key(inv.Caller())
+		if !ok {
+			return xconn.NewInvocationError("wamp.error.unavailable", "unavailable")
+		}
+
+		account, ok := e.Account(caller)
+		if !ok {
+			return xconn.NewInvocationError("wamp.error.unavailable", "unavailable")
+		}
+
+		stream, message, err := p.decryptShellMessage(inv, key.Receive)
+		if err != nil {
+			return xconn.NewInvocationError("wamp.error.invalid_argument", err.Error())
+		}
+
+		p.Lock()
+		shell, ok := p.shells[stream]
+		p.Unlock()
+
+		if !ok {
+			if !inv.Progress() {
+				// the stream ended or was aborted before its shell started
+				return xconn.NewInvocationResult()
+			}
+
+			options, err := e.KeyOptions(caller)
+			if err != nil {
+				return xconn.NewInvocationError("wamp.error.not_authorized", err.Error())
+			}
+			if !options.AllowsPTY() {
+				return xconn.NewInvocationError("wamp.error.not_authorized", "PTY allocation is disabled for this key")
+			}
+
+			var size *pty.Winsize
+			var token []byte
+			var offset uint64
+			var term string
+			resumable := false
+			if len(message) > 0 {
+				var rows, cols uint16
+				if message[0] == wampshell.MessageResume {
+					resumable = true
+					token, offset, rows, cols, term, err = wampshell.ParseResumeMessage(message)
+				} else {
+					rows, cols, err = wampshell.ParseResizeMessage(message)
+				}
+				if err != nil {
+					return xconn.NewInvocationError("wamp.error.invalid_argument", err.Error())
+				}
+				if rows > 0 && cols > 0 {
+					size = &pty.Winsize{Rows: rows, Cols: cols}
+				}
+			}
+
+			if resumable && !bytes.Equal(token, make([]byte, wampshell.ShellTokenSize)) {
+				return p.resume(inv, stream, account, key.Send, token, offset, size)
+			}
+
+			err = p.startPtySession(inv, stream, account, options, key.Send, size, term, resumable)
+			if err != nil {
+				return xconn.NewInvocationError("io.xconn.error", err.Error())
+			}
+			return xconn.NewInvocationError(xconn.ErrNoResult)
+		}
+
+		shell.Lock()
+		attached := shell.inv != nil
+		if attached {
+			shell.lastSeen = time.Now()
+		}
+		shell.Unlock()
+
+		if !attached {
+			// the caller was given up on, it has to resume the shell with a new call
+			if !inv.Progress() {
+				return xconn.NewInvocationResult()
+			}
+			return xconn.NewInvocationError(wampshell.ErrorShellDetached, "shell session was detached")
+		}
+
+		if inv.Progress() {
+			if len(message) == 0 {
+				return xconn.NewInvocationError("wamp.error.invalid_argument", "empty message")
+			}
+
+			switch message[0] {
+			case wampshell.MessageData:
+				_, err = shell.ptmx.Write(message[1:])
+				if err != nil {
+					log.Printf("Failed to write to PTY for caller %d: %v", caller, err)
+					return xconn.NewInvocationError("io.xconn.error", err.Error())
+				}
+			case wampshell.MessageResize:
+				rows, cols, err := wampshell.ParseResizeMessage(message)
+				if err != nil {
+					return xconn.NewInvocationError("wamp.error.invalid_argument", err.Error())
+				}
+				if err = pty.Setsize(shell.ptmx, &pty.Winsize{Rows: rows, Cols: cols}); err != nil {
+					log.Printf("Failed to resize PTY for caller %d: %v", caller, err)
+				}
+			case wampshell.MessageKeepalive:
+				shell.keepalive()
+			default:
+				return xconn.NewInvocationError("wamp.error.invalid_argument", "unknown message type")
+			}
+			return xconn.NewInvocationError(xconn.ErrNoResult)
+		}
+
+		// the caller closed its input or aborted the stream, either ends the shell
+		shell.Lock()
+		shell.inv = nil
+		shell.Unlock()
+		_ = shell.end()
+
+		return xconn.NewInvocationResult()
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/xconnio/wampshell"
+	"github.com/xconnio/xconn-go"
+)
+
+// fsSignature returns the block signature of request.Path, which the client uses to
+// compute the delta of an upload.
+func fsSignature(account *wampshell.Account, request *wampshell.FSRequest) (any, error) {
+	file, err := os.Open(account.Path(request.Path))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return wampshell.ComputeSignature(file, info.Size())
+}
+
+// handleSyncDelta streams the operations that turn the client's copy of a file, as
+// described by the signature in the request, into the file on this host.
+func handleSyncDelta(e *wampshell.EncryptionManager) func(_ context.Context,
+	inv *xconn.Invocation) *xconn.InvocationResult {
+	return func(_ context.Context, inv *xconn.Invocation) *xconn.InvocationResult {
+		key, ok := e.Key(inv.Caller())
+		if !ok {
+			return xconn.NewInvocationError("wamp.error.unavailable", "no encryption key for caller")
+		}
+
+		account, ok := e.Account(inv.Caller())
+		if !ok {
+			return xconn.NewInvocationError("wamp.error.unavailable", "no account for caller")
+		}
+
+		options, err := e.KeyOptions(inv.Caller())
+		if err != nil {
+			return xconn.NewInvocationError("wamp.error.not_authorized", err.Error())
+		}
+		if !options.AllowsDownload() {
+			return xconn.NewInvocationError("wamp.error.not_authorized", "download is disabled for this key")
+		}
+
+		payload, err := decryptPayload(inv, key.Receive)
+		if err != nil {
+			return xconn.NewInvocationError("wamp.error.internal_error", err.Error())
+		}
+
+		var request wampshell.SyncRequest
+		if err = json.Unmarshal(payload, &request); err != nil || request.Signature == nil {
+			return xconn.NewInvocationError("wamp.error.invalid_argument", "invalid sync request")
+		}
+		if err = request.Signature.Validate(); err != nil {
+			return xconn.NewInvocationError("wamp.error.invalid_argument", err.Error())
+		}
+
+		var file *os.File
+		err = account.Do(func() error {
+			file, err = os.Open(account.Path(request.Path))
+			return err
+		})
+		if errors.Is(err, fs.ErrNotExist) {
+			return xconn.NewInvocationError(wampshell.ErrorNotFound, err.Error())
+		} else if err != nil {
+			return xconn.NewInvocationError("wamp.error.internal_error", err.Error())
+		}
+		defer func() { _ = file.Close() }()
+
+		info, err := file.Stat()
+		if err != nil {
+			return xconn.NewInvocationError("wamp.error.internal_error", err.Error())
+		}
+		metadata := wampshell.NewFileMetadata(info)
+
+		hasher := sha256.New()
+		counter := &countingWriter{}
+		reader := io.TeeReader(file, io.MultiWriter(hasher, counter))
+		err = wampshell.ComputeDelta(reader, request.Signature, func(ops []wampshell.DeltaOp) error {
+			opsJSON, err := json.Marshal(ops)
+			if err != nil {
+				return err
+			}
+
+			encrypted, err := wampshell.EncryptPayload(opsJSON, key.Send)
+			if err != nil {
+				return err
+			}
+
+			return inv.SendProgress([]any{encrypted}, nil)
+		})
+		if err != nil {
+			return xconn.NewInvocationError("wamp.error.internal_error", err.Error())
+		}
+
+		return transferResult(&wampshell.TransferResult{
+			Size:     counter.n,
+			SHA256:   hex.EncodeToString(hasher.Sum(nil)),
+			Metadata: metadata,
+		}, key.Send)
+	}
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// patch is a delta upload in progress. The new file is built next to the old one
+// and only replaces it once it is complete.
+type patch struct {
+	path      string
+	base      *os.File
+	temp      *os.File
+	blockSize int
+	hash      hash.Hash
+	checksum  string
+	size      int64
+	account   *wampshell.Account
+	metadata  *wampshell.FileMetadata
+}
+
+type patchSession struct {
+	patches map[streamKey]*patch
+	sync.Mutex
+}
+
+func newPatchSession() *patchSession {
+	return &patchSession{
+		patches: make(map[streamKey]*patch),
+	}
+}
+
+// closePatch ends the patch of a stream.
+func (p *patchSession) closePatch(stream streamKey) {
+	p.Lock()
+	current, ok := p.patches[stream]
+	delete(p.patches, stream)
+	p.Unlock()
+
+	if ok {
+		current.close()
+	}
+}
+
+// forget ends the patches of a caller that left.
+func (p *patchSession) forget(caller uint64) {
+	p.Lock()
+	var patches []*patch
+	for stream, current := range p.patches {
+		if stream.caller == caller {
+			patches = append(patches, current)
+			delete(p.patches, stream)
+		}
+	}
+	p.Unlock()
+
+	for _, current := range patches {
+		current.close()
+	}
+}
+
+func (p *patchSession) start(account *wampshell.Account, request *wampshell.SyncRequest) (*patch, error) {
+	current := &patch{
+		path:      account.Path(request.Path),
+		blockSize: request.BlockSize,
+		hash:      sha256.New(),
+		checksum:  request.SHA256,
+		account:   account,
+		metadata:  request.Metadata,
+	}
+
+	err := account.Do(func() error {
+		base, err := os.Open(current.path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if err == nil {
+			current.base = base
+		}
+
+		current.temp, err = os.CreateTemp(filepath.Dir(current.path), "."+filepath.Base(current.path)+".wsync-*")
+		if err != nil && current.base != nil {
+			_ = current.base.Close()
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return current, nil
+}
+
+// finish moves the new file into place, keeping the mode of the file it replaces
+// unless metadata was sent.
+func (c *patch) finish() error {
+	if err := c.temp.Close(); err != nil {
+		return err
+	}
+
+	if checksum := hex.EncodeToString(c.hash.Sum(nil)); checksum != c.checksum {
+		return fmt.Errorf("checksum mismatch: expected SHA-256 %s, got %s", c.checksum, checksum)
+	}
+
+	return c.account.Do(func() error {
+		if c.base != nil {
+			if info, err := c.base.Stat(); err == nil {
+				if err = os.Chmod(c.temp.Name(), info.Mode().Perm()); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := os.Rename(c.temp.Name(), c.path); err != nil {
+			return err
+		}
+
+		if c.metadata != nil {
+			return c.metadata.Apply(c.path)
+		}
+
+		return nil
+	})
+}
+
+// close releases the files of the patch, the new file is discarded unless it was
+// already moved into place.
+func (c *patch) close() {
+	if c.base != nil {
+		_ = c.base.Close()
+	}
+	_ = c.temp.Close()
+	_ = c.account.Do(func() error {
+		_ = os.Remove(c.temp.Name())
+		return nil
+	})
+}
+
+// handleSyncPatch receives the delta computed by the client against the signature of
+// wampshell.sync.signature and rebuilds the file from it.
+func (p *patchSession) handleSyncPatch(e *wampshell.EncryptionManager) func(_ context.Context,
+	inv *xconn.Invocation) *xconn.InvocationResult {
+	e.OnLeave(p.forget)
+
+	return func(_ context.Context, inv *xconn.Invocation) *xconn.InvocationResult {
+		caller := inv.Caller()
+		key, ok := e.Key(caller)
+		if !ok {
+			return xconn.NewInvocationError("wamp.error.unavailable", "no encryption key for caller")
+		}
+
+		stream, body, err := decryptStreamMessage(inv, key.Receive)
+		if err != nil {
+			return xconn.NewInvocationError("wamp.error.invalid_argument", err.Error())
+		}
+
+		p.Lock()
+		current, ok := p.patches[stream]
+		p.Unlock()
+
+		if !ok {
+			log.Printf("handleSyncPatch called for caller: %d", caller)
+
+			account, ok := e.Account(caller)
+			if !ok {
+				return xconn.NewInvocationError("wamp.error.unavailable", "no account for caller")
+			}
+
+			options, err := e.KeyOptions(caller)
+			if err != nil {
+				return xconn.NewInvocationError("wamp.error.not_authorized", err.Error())
+			}
+			if !options.AllowsUpload() {
+				return xconn.NewInvocationError("wamp.error.not_authorized", "upload is disabled for this key")
+			}
+
+			var request wampshell.SyncRequest
+			if err = json.Unmarshal(body, &request); err != nil || request.SHA256 == "" {
+				return xconn.NewInvocationError("wamp.error.invalid_argument", "invalid sync request")
+			}
+			if err = wampshell.ValidateBlockSize(request.BlockSize); err != nil {
+				return xconn.NewInvocationError("wamp.error.invalid_argument", err.Error())
+			}
+
+			if current, err = p.start(account, &request); err != nil {
+				return xconn.NewInvocationError("wamp.error.internal_error", err.Error())
+			}
+
+			p.Lock()
+			p.patches[stream] = current
+			p.Unlock()
+		} else if isAbort(inv, body) {
+			p.closePatch(stream)
+			return xconn.NewInvocationError("wamp.error.canceled", "sync aborted by caller")
+		} else if len(body) > 0 {
+			var ops []wampshell.DeltaOp
+			if err = json.Unmarshal(body, &ops); err != nil {
+				p.closePatch(stream)
+				return xconn.NewInvocationError("wamp.error.invalid_argument", err.Error())
+			}
+
+			var base io.ReaderAt
+			if current.base != nil {
+				base = current.base
+			}
+
+			n, err := wampshell.ApplyDelta(base, current.blockSize, ops, io.MultiWriter(current.temp, current.hash))
+			current.size += n
+			if err != nil {
+				p.closePatch(stream)
+				return xconn.NewInvocationError("wamp.error.internal_error", err.Error())
+			}
+		}
+
+		if inv.Progress() {
+			return xconn.NewInvocationError(xconn.ErrNoResult)
+		}
+
+		err = current.finish()
+		p.closePatch(stream)
+		if err != nil {
+			return xconn.NewInvocationError("wamp.error.internal_error", err.Error())
+		}
+
+		log.Printf("file synced: %s (%d bytes)", current.path, current.size)
+		return transferResult(&wampshell.TransferResult{
+			Size:   current.size,
+			SHA256: hex.EncodeToString(current.hash.Sum(nil)),
+		}, key.Send)
+	}
+}
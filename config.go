@@ -10,6 +10,9 @@ import (
 
 type Config struct {
 	Principals []Principal `yaml:"principals"`
+	// GatewayPorts lets remote forwards listen on other addresses than loopback, like
+	// the sshd option of the same name.
+	GatewayPorts bool `yaml:"gateway_ports"`
 }
 
 type Principal struct {
@@ -0,0 +1,353 @@
+package wampshell
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/xconnio/xconn-go"
+)
+
+const (
+	controlRealm         = "wampshell.control"
+	procedureControlKeys = "wampshell.control.keys"
+
+	// relayBacklog is how many progressive messages of a relayed call may wait for
+	// the session to wshd.
+	relayBacklog = 8
+)
+
+// relayedProcedures are the procedures a master connection relays to wshd.
+// Forwarded connections are not relayed, remote forwards need procedures that wshd
+// calls back on the session of the client.
+func relayedProcedures() []string {
+	return []string{
+		"wampshell.shell.interactive",
+		"wampshell.shell.exec",
+		procedureFileUpload,
+		procedureFileDownload,
+		procedureFSStat,
+		procedureFSList,
+		procedureFSWalk,
+		procedureFSGlob,
+		procedureFSMkdir,
+		procedureFSRemove,
+		procedureFSRename,
+		procedureFSChmod,
+		procedureFSSymlink,
+		procedureSyncSignature,
+		procedureSyncDelta,
+		procedureSyncPatch,
+	}
+}
+
+// ControlPath is the control socket of a master connection to user@host:port. It
+// is in a directory only the current user may access, see ServeControl.
+func ControlPath(user, host, port string) (string, error) {
+	home, err := RealHome()
+	if err != nil {
+		return "", err
+	}
+
+	name := fmt.Sprintf("%s@%s", user, net.JoinHostPort(host, port))
+	return filepath.Join(home, ".wampshell", "control", name), nil
+}
+
+// ConnectControl opens a session to the master connection listening on the control
+// socket at path and returns it together with the encryption keys of the master.
+// Calls made through it are relayed to wshd over the session of the master.
+func ConnectControl(ctx context.Context, path string) (*xconn.Session, *KeyPair, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, nil, err
+	}
+
+	client := xconn.Client{SerializerSpec: CapnprotoSerializerSpec}
+	session, err := client.Connect(ctx, "unix://"+path, controlRealm)
+	if err != nil {
+		return nil, nil, fmt.Errorf("connecting to master failed: %w", err)
+	}
+
+	keysResponse := session.Call(procedureControlKeys).Do()
+	if keysResponse.Err == nil && len(keysResponse.Args) < 3 {
+		keysResponse.Err = fmt.Errorf("invalid keys from master")
+	}
+	if keysResponse.Err != nil {
+		_ = session.Leave()
+		return nil, nil, keysResponse.Err
+	}
+
+	keys := &KeyPair{}
+	for i, key := range []*[]byte{&keys.Send, &keys.Receive, &keys.PeerPublicKey} {
+		if *key, err = keysResponse.Args.Bytes(i); err != nil {
+			_ = session.Leave()
+			return nil, nil, fmt.Errorf("invalid keys from master: %w", err)
+		}
+	}
+
+	return session, keys, nil
+}
+
+// relayedCall is a progressive call of a client of the master that is relayed to
+// wshd.
+type relayedCall struct {
+	progress chan *xconn.Progress
+	// finished is closed once the call to wshd returned response
+	finished chan struct{}
+	response xconn.CallResponse
+
+	// stream is the stream of the call, nil if its first message did not carry one
+	stream *Stream
+	// left is closed once the client disconnected from the master
+	left chan struct{}
+}
+
+// abort returns the final message of a call whose client left before sending it.
+func (c *relayedCall) abort() *xconn.Progress {
+	if c.stream == nil {
+		return xconn.NewFinalProgress()
+	}
+
+	return c.stream.Abort()
+}
+
+type relayKey struct {
+	caller    uint64
+	procedure string
+}
+
+// ControlMaster shares its session to wshd with the clients that connect to its
+// control socket, which saves them the connection, authentication and key exchange.
+// wshd tells the calls of the clients apart by their stream ids.
+type ControlMaster struct {
+	session  *xconn.Session
+	keys     *KeyPair
+	path     string
+	listener net.Listener
+	local    *xconn.Session
+
+	calls map[relayKey]*relayedCall
+	sync.Mutex
+}
+
+// ServeControl makes session and keys available to other wsh, wcp and wsftp
+// processes through a control socket at path. The socket is created in a directory
+// only the current user may access, so no other user can connect to it in the
+// meantime.
+func ServeControl(path string, session *xconn.Session, keys *KeyPair) (*ControlMaster, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	if err := removeStaleControl(path); err != nil {
+		return nil, err
+	}
+
+	router := xconn.NewRouter()
+	if err := router.AddRealm(controlRealm); err != nil {
+		return nil, err
+	}
+	if err := router.AutoDiscloseCaller(controlRealm, true); err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("listening on control socket failed: %w", err)
+	}
+
+	m := &ControlMaster{
+		session:  session,
+		keys:     keys,
+		path:     path,
+		listener: listener,
+		calls:    make(map[relayKey]*relayedCall),
+	}
+
+	if m.local, err = xconn.ConnectInMemory(router, controlRealm); err != nil {
+		_ = m.Close()
+		return nil, err
+	}
+
+	if err = m.local.Register(procedureControlKeys, m.handleKeys).Do().Err; err != nil {
+		_ = m.Close()
+		return nil, err
+	}
+	for _, procedure := range relayedProcedures() {
+		if err = m.local.Register(procedure, m.relay(procedure)).Do().Err; err != nil {
+			_ = m.Close()
+			return nil, err
+		}
+	}
+
+	go NewRawSocketServer(router, nil, func(uint64, net.Addr) {}, m.forget).Serve(listener)
+
+	return m, nil
+}
+
+// removeStaleControl removes the socket of a master that exited without cleaning
+// up, but refuses to replace one that is still running.
+func removeStaleControl(path string) error {
+	if _, err := os.Lstat(path); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if conn, err := net.Dial("unix", path); err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("a master connection is already listening on %s", path)
+	}
+
+	return os.Remove(path)
+}
+
+// Close stops accepting clients and removes the control socket. The session to
+// wshd stays open.
+func (m *ControlMaster) Close() error {
+	if m.local != nil {
+		_ = m.local.Leave()
+	}
+	err := m.listener.Close()
+	if errRemove := os.Remove(m.path); errRemove != nil && !errors.Is(errRemove, os.ErrNotExist) && err == nil {
+		err = errRemove
+	}
+
+	return err
+}
+
+// forget aborts the pending calls of a client that disconnected, wshd would keep
+// their commands, shells and files otherwise.
+func (m *ControlMaster) forget(caller uint64) {
+	m.Lock()
+	for key, call := range m.calls {
+		if key.caller == caller {
+			close(call.left)
+			delete(m.calls, key)
+		}
+	}
+	m.Unlock()
+}
+
+func (m *ControlMaster) handleKeys(_ context.Context, _ *xconn.Invocation) *xconn.InvocationResult {
+	return xconn.NewInvocationResult(m.keys.Send, m.keys.Receive, m.keys.PeerPublicKey)
+}
+
+// relayResult turns the response of wshd into the result for the client.
+func relayResult(response xconn.CallResponse) *xconn.InvocationResult {
+	var wampErr *xconn.Error
+	if errors.As(response.Err, &wampErr) {
+		return xconn.NewInvocationError(wampErr.URI, wampErr.Arguments...)
+	} else if response.Err != nil {
+		return xconn.NewInvocationError("wamp.error.internal_error", response.Err.Error())
+	}
+
+	return xconn.NewInvocationResult(response.Args...)
+}
+
+// relayedStream returns the stream the first message of a relayed call belongs to.
+// The clients encrypt with the keys of the master, so it can read the stream id.
+func (m *ControlMaster) relayedStream(inv *xconn.Invocation) *Stream {
+	payload, err := inv.ArgBytes(0)
+	if err != nil {
+		return nil
+	}
+
+	message, err := DecryptPayload(payload, m.keys.Send)
+	if err != nil {
+		return nil
+	}
+
+	id, _, err := ParseStreamMessage(message)
+	if err != nil {
+		return nil
+	}
+
+	return &Stream{id: id, sendKey: m.keys.Send}
+}
+
+// relay passes the calls of procedure to wshd. Progressive results go back to the
+// client as they arrive, a progressive call is relayed as one progressive call to
+// wshd that lasts until the client sends its final message or disconnects.
+func (m *ControlMaster) relay(procedure string) xconn.InvocationHandler {
+	return func(_ context.Context, inv *xconn.Invocation) *xconn.InvocationResult {
+		key := relayKey{caller: inv.Caller(), procedure: procedure}
+		sendProgress := func(result *xconn.InvocationResult) {
+			_ = inv.SendProgress(result.Args, nil)
+		}
+
+		m.Lock()
+		call, ok := m.calls[key]
+		m.Unlock()
+
+		if !ok && !inv.Progress() {
+			return relayResult(m.session.Call(procedure).Args(inv.Args()...).ProgressReceiver(sendProgress).Do())
+		}
+
+		if !ok {
+			call = &relayedCall{
+				progress: make(chan *xconn.Progress, relayBacklog),
+				finished: make(chan struct{}),
+				stream:   m.relayedStream(inv),
+				left:     make(chan struct{}),
+			}
+			m.Lock()
+			m.calls[key] = call
+			m.Unlock()
+
+			go func() {
+				call.response = m.session.Call(procedure).
+					ProgressSender(func(context.Context) *xconn.Progress {
+						select {
+						case progress := <-call.progress:
+							return progress
+						case <-call.left:
+						}
+
+						// what the client sent before it left still goes first
+						select {
+						case progress := <-call.progress:
+							return progress
+						default:
+							return call.abort()
+						}
+					}).
+					ProgressReceiver(sendProgress).Do()
+				close(call.finished)
+			}()
+		}
+
+		progress := xconn.NewProgress(inv.Args()...)
+		if !inv.Progress() {
+			progress = xconn.NewFinalProgress(inv.Args()...)
+		}
+
+		select {
+		case call.progress <- progress:
+		case <-call.finished:
+			// wshd ended the call early, the client learns why with its next message
+			m.forgetCall(key, call)
+			return relayResult(call.response)
+		}
+
+		if inv.Progress() {
+			return xconn.NewInvocationError(xconn.ErrNoResult)
+		}
+
+		<-call.finished
+		m.forgetCall(key, call)
+		return relayResult(call.response)
+	}
+}
+
+func (m *ControlMaster) forgetCall(key relayKey, call *relayedCall) {
+	m.Lock()
+	if m.calls[key] == call {
+		delete(m.calls, key)
+	}
+	m.Unlock()
+}
@@ -0,0 +1,359 @@
+package wampshell
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	minBlockSize = 2 * 1024
+	maxBlockSize = 1024 * 1024
+	strongSize   = 16
+	// maxDeltaOps bounds the number of operations sent in one progressive message.
+	maxDeltaOps = 4096
+)
+
+// BlockSignature identifies one block of a file by a cheap rolling checksum and a
+// truncated SHA-256.
+type BlockSignature struct {
+	Weak   uint32 `json:"weak"`
+	Strong []byte `json:"strong"`
+}
+
+// Signature describes the file the receiver already has, the sender uses it to only
+// send the data the receiver is missing.
+type Signature struct {
+	Size      int64            `json:"size"`
+	BlockSize int              `json:"block_size"`
+	Blocks    []BlockSignature `json:"blocks"`
+}
+
+// DeltaOp is one step of rebuilding a file, either Count blocks copied from the
+// receiver's old file starting at Block, or literal Data if Count is zero.
+type DeltaOp struct {
+	Block int    `json:"block,omitempty"`
+	Count int    `json:"count,omitempty"`
+	Data  []byte `json:"data,omitempty"`
+}
+
+// SyncRequest starts a delta transfer. Downloads carry the Signature of the local
+// file, uploads the BlockSize of the signature the delta was computed against and
+// the SHA256 of the new file, which is checked before it replaces the old one.
+type SyncRequest struct {
+	Path      string        `json:"path"`
+	BlockSize int           `json:"block_size,omitempty"`
+	Signature *Signature    `json:"signature,omitempty"`
+	SHA256    string        `json:"sha256,omitempty"`
+	Metadata  *FileMetadata `json:"metadata,omitempty"`
+}
+
+// BlockSizeFor picks a block size that grows with the square root of the file size,
+// like rsync does, which keeps both the signature and the delta small.
+func BlockSizeFor(size int64) int {
+	blockSize := int(math.Sqrt(float64(size)))
+	blockSize = (blockSize + 1023) / 1024 * 1024
+
+	return min(max(blockSize, minBlockSize), maxBlockSize)
+}
+
+// rollingChecksum is the rsync weak checksum of a window of bytes, it can be moved
+// forward by one byte in constant time.
+type rollingChecksum struct {
+	a, b uint32
+	n    uint32
+}
+
+func newRollingChecksum(data []byte) rollingChecksum {
+	var r rollingChecksum
+	for i, c := range data {
+		r.a += uint32(c)
+		r.b += uint32(len(data)-i) * uint32(c) //nolint:gosec
+	}
+	r.n = uint32(len(data)) //nolint:gosec
+
+	return r
+}
+
+// roll removes out from the start of the window and appends in to its end.
+func (r *rollingChecksum) roll(out, in byte) {
+	r.a = r.a - uint32(out) + uint32(in)
+	r.b = r.b - r.n*uint32(out) + r.a
+}
+
+// shrink removes out from the start of the window.
+func (r *rollingChecksum) shrink(out byte) {
+	r.a -= uint32(out)
+	r.b -= r.n * uint32(out)
+	r.n--
+}
+
+func (r *rollingChecksum) sum() uint32 {
+	return r.a&0xffff | r.b<<16
+}
+
+func strongChecksum(parts ...[]byte) []byte {
+	hasher := sha256.New()
+	for _, part := range parts {
+		hasher.Write(part)
+	}
+
+	return hasher.Sum(nil)[:strongSize]
+}
+
+// ComputeSignature reads the file of the given size from reader and returns the
+// signature of its blocks. Data after size is ignored and the size is that of the
+// data read, so that the signature stays consistent if the file changes meanwhile.
+func ComputeSignature(reader io.Reader, size int64) (*Signature, error) {
+	signature := &Signature{BlockSize: BlockSizeFor(size)}
+	reader = io.LimitReader(reader, size)
+
+	buf := make([]byte, signature.BlockSize)
+	for {
+		n, err := io.ReadFull(reader, buf)
+		signature.Size += int64(n)
+		if n > 0 {
+			roll := newRollingChecksum(buf[:n])
+			signature.Blocks = append(signature.Blocks, BlockSignature{
+				Weak:   roll.sum(),
+				Strong: strongChecksum(buf[:n]),
+			})
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return signature, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// ValidateBlockSize checks that a block size received from the other side is one
+// that BlockSizeFor can pick, which bounds the memory used to process it.
+func ValidateBlockSize(blockSize int) error {
+	if blockSize < minBlockSize || blockSize > maxBlockSize {
+		return fmt.Errorf("invalid block size %d", blockSize)
+	}
+
+	return nil
+}
+
+// Validate checks that a signature received from the other side is consistent, its
+// block size must be valid and it must have one block for every BlockSize bytes.
+func (s *Signature) Validate() error {
+	if err := ValidateBlockSize(s.BlockSize); err != nil {
+		return err
+	}
+	if s.Size < 0 {
+		return fmt.Errorf("invalid file size %d", s.Size)
+	}
+
+	blocks := (s.Size + int64(s.BlockSize) - 1) / int64(s.BlockSize)
+	if int64(len(s.Blocks)) != blocks {
+		return fmt.Errorf("signature has %d blocks, expected %d", len(s.Blocks), blocks)
+	}
+	for i := range s.Blocks {
+		if len(s.Blocks[i].Strong) != strongSize {
+			return fmt.Errorf("invalid checksum of block %d", i)
+		}
+	}
+
+	return nil
+}
+
+// blockLength returns the length of block i, only the last block may be shorter
+// than the block size.
+func (s *Signature) blockLength(i int) int {
+	if i == len(s.Blocks)-1 && s.Size%int64(s.BlockSize) != 0 {
+		return int(s.Size % int64(s.BlockSize))
+	}
+
+	return s.BlockSize
+}
+
+// deltaWriter batches operations before handing them to emit and merges copies of
+// consecutive blocks.
+type deltaWriter struct {
+	ops     []DeltaOp
+	literal int
+	emit    func([]DeltaOp) error
+}
+
+func (w *deltaWriter) copyBlock(block int) error {
+	if n := len(w.ops); n > 0 && w.ops[n-1].Count > 0 && w.ops[n-1].Block+w.ops[n-1].Count == block {
+		w.ops[n-1].Count++
+		return nil
+	}
+
+	w.ops = append(w.ops, DeltaOp{Block: block, Count: 1})
+	return w.flushIfFull()
+}
+
+func (w *deltaWriter) addLiteral(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	w.ops = append(w.ops, DeltaOp{Data: bytes.Clone(data)})
+	w.literal += len(data)
+	return w.flushIfFull()
+}
+
+func (w *deltaWriter) flushIfFull() error {
+	if w.literal >= TransferChunkSize || len(w.ops) >= maxDeltaOps {
+		return w.flush()
+	}
+
+	return nil
+}
+
+func (w *deltaWriter) flush() error {
+	if len(w.ops) == 0 {
+		return nil
+	}
+
+	ops := w.ops
+	w.ops, w.literal = nil, 0
+	return w.emit(ops)
+}
+
+// ComputeDelta reads the new version of a file from reader and passes the operations
+// that rebuild it from the file described by signature to emit, in batches.
+func ComputeDelta(reader io.Reader, signature *Signature, emit func([]DeltaOp) error) error {
+	if err := signature.Validate(); err != nil {
+		return err
+	}
+
+	blocks := make(map[uint32][]int, len(signature.Blocks))
+	for i, block := range signature.Blocks {
+		blocks[block.Weak] = append(blocks[block.Weak], i)
+	}
+
+	blockSize := signature.BlockSize
+
+	input := bufio.NewReaderSize(reader, TransferChunkSize)
+	writer := &deltaWriter{emit: emit}
+
+	// the window is a ring buffer of up to blockSize bytes starting at head
+	ring := make([]byte, blockSize)
+	var head, length int
+	literal := make([]byte, 0, TransferChunkSize)
+
+	fill := func() error {
+		head, length = 0, 0
+		n, err := io.ReadFull(input, ring)
+		length = n
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil
+		}
+		return err
+	}
+
+	window := func() ([]byte, []byte) {
+		if head+length <= blockSize {
+			return ring[head : head+length], nil
+		}
+		return ring[head:], ring[:head+length-blockSize]
+	}
+
+	match := func(weak uint32) int {
+		for _, i := range blocks[weak] {
+			if signature.blockLength(i) != length {
+				continue
+			}
+			first, second := window()
+			if bytes.Equal(strongChecksum(first, second), signature.Blocks[i].Strong) {
+				return i
+			}
+		}
+		return -1
+	}
+
+	if err := fill(); err != nil {
+		return err
+	}
+	first, _ := window()
+	roll := newRollingChecksum(first)
+
+	for length > 0 {
+		if block := match(roll.sum()); block >= 0 {
+			if err := writer.addLiteral(literal); err != nil {
+				return err
+			}
+			literal = literal[:0]
+			if err := writer.copyBlock(block); err != nil {
+				return err
+			}
+
+			if err := fill(); err != nil {
+				return err
+			}
+			first, _ = window()
+			roll = newRollingChecksum(first)
+			continue
+		}
+
+		out := ring[head]
+		literal = append(literal, out)
+		if len(literal) == cap(literal) {
+			if err := writer.addLiteral(literal); err != nil {
+				return err
+			}
+			literal = literal[:0]
+		}
+
+		in, err := input.ReadByte()
+		switch {
+		case errors.Is(err, io.EOF):
+			roll.shrink(out)
+			head = (head + 1) % blockSize
+			length--
+		case err != nil:
+			return err
+		default:
+			// the window is full, the incoming byte takes the place of the outgoing one
+			ring[head] = in
+			head = (head + 1) % blockSize
+			roll.roll(out, in)
+		}
+	}
+
+	if err := writer.addLiteral(literal); err != nil {
+		return err
+	}
+
+	return writer.flush()
+}
+
+// ApplyDelta writes the data described by ops to out, copied blocks are read from
+// base, the receiver's old file.
+func ApplyDelta(base io.ReaderAt, blockSize int, ops []DeltaOp, out io.Writer) (int64, error) {
+	var written int64
+	for _, op := range ops {
+		if op.Count == 0 {
+			n, err := out.Write(op.Data)
+			written += int64(n)
+			if err != nil {
+				return written, err
+			}
+			continue
+		}
+
+		if base == nil || op.Block < 0 || op.Count < 0 {
+			return written, fmt.Errorf("invalid block reference %d+%d", op.Block, op.Count)
+		}
+
+		offset := int64(op.Block) * int64(blockSize)
+		n, err := io.Copy(out, io.NewSectionReader(base, offset, int64(op.Count)*int64(blockSize)))
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
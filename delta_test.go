@@ -0,0 +1,194 @@
+package wampshell_test
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/xconnio/wampshell"
+)
+
+const testBlockSize = 2048
+
+func randomBytes(seed int64, n int) []byte {
+	data := make([]byte, n)
+	_, _ = rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// syncBytes rebuilds target from base the way a delta transfer does and returns the
+// result and the number of bytes that were sent as literal data.
+func syncBytes(t *testing.T, base, target []byte) ([]byte, int) {
+	t.Helper()
+
+	signature, err := wampshell.ComputeSignature(bytes.NewReader(base), int64(len(base)))
+	if err != nil {
+		t.Fatalf("failed to compute signature: %v", err)
+	}
+	if err = signature.Validate(); err != nil {
+		t.Fatalf("invalid signature: %v", err)
+	}
+
+	var out bytes.Buffer
+	literal := 0
+	err = wampshell.ComputeDelta(bytes.NewReader(target), signature, func(ops []wampshell.DeltaOp) error {
+		for _, op := range ops {
+			if op.Count == 0 {
+				literal += len(op.Data)
+			}
+		}
+		_, err := wampshell.ApplyDelta(bytes.NewReader(base), signature.BlockSize, ops, &out)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to compute delta: %v", err)
+	}
+
+	return out.Bytes(), literal
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	file := randomBytes(1, 5*testBlockSize+904)
+	junk := randomBytes(2, 3000)
+
+	tests := []struct {
+		name   string
+		base   []byte
+		target []byte
+		// literal is the number of bytes that may not be copied from base
+		literal int
+	}{
+		{name: "both empty", base: nil, target: nil},
+		{name: "empty base", base: nil, target: file, literal: len(file)},
+		{name: "empty target", base: file, target: nil},
+		{name: "unchanged", base: file, target: file},
+		{name: "smaller than a block", base: file[:1000], target: file[:1000]},
+		{name: "on a block boundary", base: file[:2*testBlockSize], target: file[:2*testBlockSize]},
+		{name: "appended tail", base: file[:3*testBlockSize], target: file, literal: len(file) - 3*testBlockSize},
+		{name: "truncated", base: file, target: file[:2*testBlockSize+100], literal: 100},
+		{
+			name:    "inserted byte",
+			base:    file,
+			target:  concat(file[:3000], []byte{0x42}, file[3000:]),
+			literal: testBlockSize + 1,
+		},
+		{
+			// the window wraps around the ring buffer many times before a block matches
+			name:    "shifted by more than a block",
+			base:    file,
+			target:  concat(junk, file),
+			literal: len(junk),
+		},
+		{
+			// the short last block is only found once the window shrinks at the end
+			name:    "junk before the last block",
+			base:    file,
+			target:  concat(file[:5*testBlockSize], junk[:5], file[5*testBlockSize:]),
+			literal: 5,
+		},
+		{
+			name:    "replaced block",
+			base:    file,
+			target:  concat(file[:testBlockSize], junk[:testBlockSize], file[2*testBlockSize:]),
+			literal: testBlockSize,
+		},
+		{
+			// literal data is sent in several batches
+			name:    "large literal",
+			base:    file[:testBlockSize],
+			target:  concat(randomBytes(3, 3*wampshell.TransferChunkSize), file[:testBlockSize]),
+			literal: 3 * wampshell.TransferChunkSize,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, literal := syncBytes(t, tt.base, tt.target)
+			if !bytes.Equal(out, tt.target) {
+				t.Fatalf("rebuilt %d bytes that differ from the %d bytes of the target", len(out), len(tt.target))
+			}
+			if literal > tt.literal {
+				t.Fatalf("sent %d literal bytes, expected at most %d", literal, tt.literal)
+			}
+		})
+	}
+}
+
+func TestBlockSizeFor(t *testing.T) {
+	tests := []struct {
+		size int64
+		want int
+	}{
+		{0, 2048},
+		{4 * 1024 * 1024, 2048},
+		{100 * 1024 * 1024, 10240},
+		{1 << 40, 1024 * 1024},
+		{1 << 50, 1024 * 1024},
+	}
+
+	for _, tt := range tests {
+		if got := wampshell.BlockSizeFor(tt.size); got != tt.want {
+			t.Errorf("BlockSizeFor(%d) = %d, want %d", tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestSignatureValidate(t *testing.T) {
+	block := wampshell.BlockSignature{Strong: make([]byte, 16)}
+
+	tests := []struct {
+		name      string
+		signature wampshell.Signature
+		valid     bool
+	}{
+		{name: "empty", signature: wampshell.Signature{BlockSize: 2048}, valid: true},
+		{
+			name:      "short last block",
+			signature: wampshell.Signature{Size: 2049, BlockSize: 2048, Blocks: []wampshell.BlockSignature{block, block}},
+			valid:     true,
+		},
+		{name: "zero block size", signature: wampshell.Signature{}},
+		{name: "small block size", signature: wampshell.Signature{BlockSize: 1}},
+		{name: "large block size", signature: wampshell.Signature{BlockSize: 1 << 30}},
+		{name: "negative size", signature: wampshell.Signature{Size: -1, BlockSize: 2048}},
+		{
+			name:      "missing block",
+			signature: wampshell.Signature{Size: 2049, BlockSize: 2048, Blocks: []wampshell.BlockSignature{block}},
+		},
+		{
+			name:      "extra block",
+			signature: wampshell.Signature{Size: 10, BlockSize: 2048, Blocks: []wampshell.BlockSignature{block, block}},
+		},
+		{
+			name:      "short checksum",
+			signature: wampshell.Signature{Size: 10, BlockSize: 2048, Blocks: []wampshell.BlockSignature{{}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.signature.Validate()
+			if tt.valid && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestApplyDeltaInvalidBlock(t *testing.T) {
+	ops := []wampshell.DeltaOp{{Block: -1, Count: 1}}
+	if _, err := wampshell.ApplyDelta(bytes.NewReader(nil), testBlockSize, ops, &bytes.Buffer{}); err == nil {
+		t.Fatal("expected a negative block to be refused")
+	}
+
+	if _, err := wampshell.ApplyDelta(nil, testBlockSize, []wampshell.DeltaOp{{Count: 1}}, &bytes.Buffer{}); err == nil {
+		t.Fatal("expected a block copy without a base file to be refused")
+	}
+}
@@ -2,29 +2,71 @@ package wampshell
 
 import (
 	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
 	"sync"
+	"time"
 
 	"github.com/xconnio/berncrypt/go"
 	"github.com/xconnio/xconn-go"
 )
 
+const nonceSize = 12
+
 type KeyPair struct {
 	Send    []byte
 	Receive []byte
+
+	// PeerPublicKey is the ed25519 identity key the peer signed its key exchange with.
+	PeerPublicKey []byte
+}
+
+// EncryptPayload encrypts data with key and prepends the nonce, the format every
+// encrypted WAMP argument uses.
+func EncryptPayload(data, key []byte) ([]byte, error) {
+	ciphertext, nonce, err := berncrypt.EncryptChaCha20Poly1305(data, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(nonce, ciphertext...), nil
+}
+
+func DecryptPayload(payload, key []byte) ([]byte, error) {
+	if len(payload) < nonceSize {
+		return nil, fmt.Errorf("payload too short")
+	}
+
+	return berncrypt.DecryptChaCha20Poly1305(payload[nonceSize:], payload[:nonceSize], key)
 }
 
 type EncryptionManager struct {
-	router *xconn.Router
+	router   *xconn.Router
+	keyStore *KeyStore
+	hostKey  ed25519.PrivateKey
 
-	keys map[uint64]*KeyPair
+	keys     map[uint64]*KeyPair
+	accounts map[uint64]*Account
+	options  map[uint64]*KeyOptions
+	// peers are the addresses of the sessions that connected directly
+	peers map[uint64]net.IP
 
+	leaveCallbacks []func(sessionID uint64)
 	sync.Mutex
 }
 
-func NewEncryptionManager(router *xconn.Router) *EncryptionManager {
+func NewEncryptionManager(router *xconn.Router, keyStore *KeyStore, hostKey ed25519.PrivateKey) *EncryptionManager {
 	return &EncryptionManager{
-		router: router,
-		keys:   make(map[uint64]*KeyPair),
+		router:   router,
+		keyStore: keyStore,
+		hostKey:  hostKey,
+		keys:     make(map[uint64]*KeyPair),
+		accounts: make(map[uint64]*Account),
+		options:  make(map[uint64]*KeyOptions),
+		peers:    make(map[uint64]net.IP),
 	}
 }
 
@@ -48,11 +90,52 @@ func (e *EncryptionManager) Setup() error {
 }
 
 func (e *EncryptionManager) HandleKeyExchange(_ context.Context, invocation *xconn.Invocation) *xconn.InvocationResult {
+	if len(invocation.Args()) < 4 {
+		return xconn.NewInvocationError("wamp.error.invalid_argument",
+			"expected public key, identity public key, signature and username")
+	}
+
 	publicKeyPeer, err := invocation.ArgBytes(0)
 	if err != nil {
 		return xconn.NewInvocationError("wamp.error.invalid_argument", err.Error())
 	}
 
+	identityPeer, err := invocation.ArgBytes(1)
+	if err != nil {
+		return xconn.NewInvocationError("wamp.error.invalid_argument", err.Error())
+	}
+
+	signaturePeer, err := invocation.ArgBytes(2)
+	if err != nil {
+		return xconn.NewInvocationError("wamp.error.invalid_argument", err.Error())
+	}
+
+	username, err := invocation.ArgString(3)
+	if err != nil {
+		return xconn.NewInvocationError("wamp.error.invalid_argument", err.Error())
+	}
+
+	if len(identityPeer) != ed25519.PublicKeySize ||
+		!ed25519.Verify(identityPeer, keyExchangeMessage(publicKeyPeer, []byte(username)), signaturePeer) {
+		return xconn.NewInvocationError("wamp.error.authorization_failed", "invalid key exchange signature")
+	}
+
+	account, options, err := AuthorizeAccount(e.keyStore, username, hex.EncodeToString(identityPeer))
+	if err != nil {
+		return xconn.NewInvocationError("wamp.error.authorization_failed", err.Error())
+	}
+
+	sessionID := invocation.Caller()
+
+	e.Lock()
+	peer := e.peers[sessionID]
+	e.Unlock()
+
+	if err = options.AllowsSource(peer); err != nil {
+		log.Printf("key exchange of session %d refused: %v", sessionID, err)
+		return xconn.NewInvocationError("wamp.error.authorization_failed", err.Error())
+	}
+
 	publicKey, privateKey, err := berncrypt.CreateX25519KeyPair()
 	if err != nil {
 		return xconn.NewInvocationError("wamp.error.internal_error", err.Error())
@@ -73,13 +156,16 @@ func (e *EncryptionManager) HandleKeyExchange(_ context.Context, invocation *xco
 		return xconn.NewInvocationError("wamp.error.internal_error", err.Error())
 	}
 
-	sessionID := invocation.Caller()
-
 	e.Lock()
-	e.keys[sessionID] = &KeyPair{Send: sendKey, Receive: receiveKey}
+	e.keys[sessionID] = &KeyPair{Send: sendKey, Receive: receiveKey, PeerPublicKey: identityPeer}
+	e.accounts[sessionID] = account
+	e.options[sessionID] = options
 	e.Unlock()
 
-	return xconn.NewInvocationResult(publicKey)
+	hostPublicKey := e.hostKey.Public().(ed25519.PublicKey)
+	signature := ed25519.Sign(e.hostKey, keyExchangeMessage(publicKey, publicKeyPeer, identityPeer))
+
+	return xconn.NewInvocationResult(publicKey, []byte(hostPublicKey), signature)
 }
 
 func (e *EncryptionManager) TestEcho(_ context.Context, invocation *xconn.Invocation) *xconn.InvocationResult {
@@ -122,3 +208,60 @@ func (e *EncryptionManager) Key(sessionID uint64) (*KeyPair, bool) {
 	key, ok := e.keys[sessionID]
 	return key, ok
 }
+
+func (e *EncryptionManager) Account(sessionID uint64) (*Account, bool) {
+	e.Lock()
+	defer e.Unlock()
+	account, ok := e.accounts[sessionID]
+	return account, ok
+}
+
+// Join records the address a session connected from, which from= restrictions
+// are checked against. Only TCP addresses are kept.
+func (e *EncryptionManager) Join(sessionID uint64, addr net.Addr) {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return
+	}
+
+	e.Lock()
+	defer e.Unlock()
+	e.peers[sessionID] = tcpAddr.IP
+}
+
+// OnLeave registers callback to be run with the id of every session that leaves,
+// to release what a handler kept for it.
+func (e *EncryptionManager) OnLeave(callback func(sessionID uint64)) {
+	e.Lock()
+	defer e.Unlock()
+	e.leaveCallbacks = append(e.leaveCallbacks, callback)
+}
+
+// Leave forgets the keys of a session that left and runs the OnLeave callbacks.
+func (e *EncryptionManager) Leave(sessionID uint64) {
+	e.Lock()
+	delete(e.keys, sessionID)
+	delete(e.accounts, sessionID)
+	delete(e.options, sessionID)
+	delete(e.peers, sessionID)
+	callbacks := e.leaveCallbacks
+	e.Unlock()
+
+	for _, callback := range callbacks {
+		callback(sessionID)
+	}
+}
+
+// KeyOptions returns the restrictions of the key a session authenticated its key
+// exchange with. An expired key gets an error even for a session set up before.
+func (e *EncryptionManager) KeyOptions(sessionID uint64) (*KeyOptions, error) {
+	e.Lock()
+	options, ok := e.options[sessionID]
+	e.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("no key exchange for session")
+	}
+
+	return options, options.Valid(time.Now())
+}
@@ -0,0 +1,22 @@
+package wampshell
+
+const (
+	StreamStdout byte = 0x01
+	StreamStderr byte = 0x02
+)
+
+// ExecRequest describes a command to run on the remote host. Argv is executed
+// directly unless Shell is set, in which case Argv[0] is a shell command line and
+// the remaining elements become its positional parameters.
+type ExecRequest struct {
+	Argv  []string `json:"argv"`
+	Shell bool     `json:"shell"`
+	PTY   bool     `json:"pty"`
+	// Term is the terminal type of the client, sent along with PTY.
+	Term string `json:"term,omitempty"`
+}
+
+type ExitStatus struct {
+	Code   int `json:"code"`
+	Signal int `json:"signal,omitempty"`
+}
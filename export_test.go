@@ -0,0 +1,9 @@
+package wampshell
+
+type RawSocketPeer = rawSocketPeer
+
+var (
+	AcceptRawSocket = acceptRawSocket
+	ParseKeyOptions = parseKeyOptions
+	ParseKeys       = parseKeys
+)
@@ -0,0 +1,655 @@
+package wampshell
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/xconnio/xconn-go"
+)
+
+const (
+	procedureFileUpload   = "wampshell.shell.upload"
+	procedureFileDownload = "wampshell.shell.download"
+	procedureFSStat       = "wampshell.fs.stat"
+	procedureFSList       = "wampshell.fs.list"
+	procedureFSWalk       = "wampshell.fs.walk"
+	procedureFSGlob       = "wampshell.fs.glob"
+	procedureFSMkdir      = "wampshell.fs.mkdir"
+	procedureFSRemove     = "wampshell.fs.remove"
+	procedureFSRename     = "wampshell.fs.rename"
+	procedureFSChmod      = "wampshell.fs.chmod"
+	procedureFSSymlink    = "wampshell.fs.symlink"
+)
+
+// Transfer describes a file copied by a FileClient. Size is the size of the whole
+// file or negative if it is not known, Offset the amount skipped because an earlier
+// transfer already copied it.
+type Transfer struct {
+	Source      string
+	Destination string
+	Upload      bool
+	Size        int64
+	Offset      int64
+}
+
+// TransferProgress is informed about every file a FileClient transfers.
+type TransferProgress interface {
+	// Start is called before the data of a file is sent.
+	Start(transfer *Transfer)
+	// Add is called for every chunk of n bytes.
+	Add(n int)
+	// Finish is called once the file is complete and verified.
+	Finish()
+}
+
+type noProgress struct{}
+
+func (noProgress) Start(*Transfer) {}
+func (noProgress) Add(int)         {}
+func (noProgress) Finish()         {}
+
+// TransferOptions control what is copied besides the file contents.
+type TransferOptions struct {
+	Preserve      bool
+	PreserveOwner bool
+	Resume        bool
+	Progress      TransferProgress
+}
+
+// metadata returns the part of m that should be applied to the destination, or nil
+// if nothing is to be preserved.
+func (o *TransferOptions) metadata(m *FileMetadata) *FileMetadata {
+	if !o.Preserve || m == nil {
+		return nil
+	}
+
+	metadata := *m
+	if !o.PreserveOwner {
+		metadata.UID, metadata.GID = nil, nil
+	}
+
+	return &metadata
+}
+
+func (o *TransferOptions) progress() TransferProgress {
+	if o.Progress == nil {
+		return noProgress{}
+	}
+
+	return o.Progress
+}
+
+// FileClient transfers and manages files on a wshd host over an encrypted session.
+type FileClient struct {
+	session *xconn.Session
+	keys    *KeyPair
+}
+
+func NewFileClient(session *xconn.Session, keys *KeyPair) *FileClient {
+	return &FileClient{session: session, keys: keys}
+}
+
+func (c *FileClient) encryptJSON(v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return EncryptPayload(data, c.keys.Send)
+}
+
+// decryptJSON decodes the encrypted JSON result of a call into v, which may be nil
+// for procedures that only report success.
+func (c *FileClient) decryptJSON(callResponse xconn.CallResponse, v any) error {
+	encResp, err := callResponse.Args.Bytes(0)
+	if err != nil {
+		return fmt.Errorf("parsing response failed: %w", err)
+	}
+
+	plainResp, err := DecryptPayload(encResp, c.keys.Receive)
+	if err != nil {
+		return fmt.Errorf("response decryption failed: %w", err)
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	if err = json.Unmarshal(plainResp, v); err != nil {
+		return fmt.Errorf("parsing response failed: %w", err)
+	}
+
+	return nil
+}
+
+// call calls one of the wampshell.fs procedures and decodes its result into result.
+func (c *FileClient) call(procedure string, request *FSRequest, result any) error {
+	payload, err := c.encryptJSON(request)
+	if err != nil {
+		return err
+	}
+
+	callResponse := c.session.Call(procedure).Arg(payload).Do()
+	if callResponse.Err != nil {
+		return fmt.Errorf("%s failed for %s: %w", procedure, request.Path, callResponse.Err)
+	}
+
+	return c.decryptJSON(callResponse, result)
+}
+
+// IsNotFound reports whether err was returned because a remote path does not exist.
+func IsNotFound(err error) bool {
+	var wampErr *xconn.Error
+	return errors.As(err, &wampErr) && wampErr.URI == ErrorNotFound
+}
+
+func (c *FileClient) Stat(remotePath string) (*FileEntry, error) {
+	var entry FileEntry
+	if err := c.call(procedureFSStat, &FSRequest{Path: remotePath}, &entry); err != nil {
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+// StatFollow is Stat for what a symlink at remotePath points to.
+func (c *FileClient) StatFollow(remotePath string) (*FileEntry, error) {
+	var entry FileEntry
+	if err := c.call(procedureFSStat, &FSRequest{Path: remotePath, Follow: true}, &entry); err != nil {
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+func (c *FileClient) List(remotePath string) ([]FileEntry, error) {
+	var entries []FileEntry
+	if err := c.call(procedureFSList, &FSRequest{Path: remotePath}, &entries); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+func (c *FileClient) Walk(remotePath string) ([]FileEntry, error) {
+	var entries []FileEntry
+	if err := c.call(procedureFSWalk, &FSRequest{Path: remotePath}, &entries); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// Glob returns the remote paths matching pattern, using the syntax of path.Match.
+// Matches of a relative pattern are relative to the remote home directory.
+func (c *FileClient) Glob(pattern string) ([]string, error) {
+	var matches []string
+	if err := c.call(procedureFSGlob, &FSRequest{Path: pattern}, &matches); err != nil {
+		return nil, err
+	}
+
+	return matches, nil
+}
+
+func (c *FileClient) Mkdir(remotePath string, mode os.FileMode, recursive bool) error {
+	return c.call(procedureFSMkdir, &FSRequest{Path: remotePath, Mode: mode, Recursive: recursive}, nil)
+}
+
+func (c *FileClient) Remove(remotePath string, recursive bool) error {
+	return c.call(procedureFSRemove, &FSRequest{Path: remotePath, Recursive: recursive}, nil)
+}
+
+func (c *FileClient) Rename(remotePath, target string) error {
+	return c.call(procedureFSRename, &FSRequest{Path: remotePath, Target: target}, nil)
+}
+
+func (c *FileClient) Chmod(remotePath string, mode os.FileMode) error {
+	return c.call(procedureFSChmod, &FSRequest{Path: remotePath, Mode: mode}, nil)
+}
+
+func (c *FileClient) Symlink(remotePath, target string) error {
+	return c.call(procedureFSSymlink, &FSRequest{Path: remotePath, Target: target}, nil)
+}
+
+// verifyTransfer compares the size and checksum of the whole file on both sides.
+func verifyTransfer(result *TransferResult, size int64, hasher hash.Hash) error {
+	if result.Size != size {
+		return fmt.Errorf("size mismatch: local file has %d bytes, remote file has %d bytes", size, result.Size)
+	}
+
+	checksum := hex.EncodeToString(hasher.Sum(nil))
+	if result.SHA256 != checksum {
+		return fmt.Errorf("checksum mismatch: local file has SHA-256 %s, remote file has %s", checksum, result.SHA256)
+	}
+
+	return nil
+}
+
+// resumeOffset returns the size of a partial upload at remotePath, which is where
+// a resumed upload continues.
+func (c *FileClient) resumeOffset(remotePath string, size int64) (int64, error) {
+	entry, err := c.Stat(remotePath)
+	if IsNotFound(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	if entry.Type != FileTypeRegular {
+		return 0, fmt.Errorf("cannot resume upload: %s is not a regular file", remotePath)
+	}
+	if entry.Size > size {
+		return 0, fmt.Errorf("cannot resume upload: remote file %s is larger than the local file", remotePath)
+	}
+
+	return entry.Size, nil
+}
+
+// Upload copies the local file at localPath to remotePath.
+func (c *FileClient) Upload(localPath, remotePath string, opts *TransferOptions) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to open local file: %w", err)
+	}
+	defer func() { _ = file.Close() }()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to open local file: %w", err)
+	}
+
+	var offset int64
+	if opts.Resume {
+		if offset, err = c.resumeOffset(remotePath, info.Size()); err != nil {
+			return err
+		}
+	}
+
+	hasher, err := HashPrefix(file, offset)
+	if err != nil {
+		return fmt.Errorf("failed to read local file: %w", err)
+	}
+
+	stream, err := NewStream(c.keys.Send)
+	if err != nil {
+		return err
+	}
+	request := &TransferRequest{
+		Path:     remotePath,
+		Offset:   offset,
+		Metadata: opts.metadata(NewFileMetadata(info)),
+	}
+	header, err := stream.EncryptJSON(request)
+	if err != nil {
+		return err
+	}
+
+	progress := opts.progress()
+	progress.Start(&Transfer{
+		Source:      localPath,
+		Destination: remotePath,
+		Upload:      true,
+		Size:        info.Size(),
+		Offset:      offset,
+	})
+
+	sent := offset
+	var readErr error
+	firstProgress := true
+	buf := make([]byte, TransferChunkSize)
+
+	callResponse := c.session.Call(procedureFileUpload).
+		ProgressSender(func(ctx context.Context) *xconn.Progress {
+			if firstProgress {
+				firstProgress = false
+				return xconn.NewProgress(header)
+			}
+
+			n, err := file.Read(buf)
+			if n > 0 {
+				payload, errEnc := stream.Encrypt(buf[:n])
+				if errEnc != nil {
+					readErr = errEnc
+					return stream.Abort()
+				}
+				hasher.Write(buf[:n])
+				sent += int64(n)
+				progress.Add(n)
+				return xconn.NewProgress(payload)
+			}
+			if err != nil && !errors.Is(err, io.EOF) {
+				readErr = fmt.Errorf("failed to read local file: %w", err)
+				return stream.Abort()
+			}
+			return stream.Final()
+		}).Do()
+	// a failed read aborts the upload, its error is the one worth reporting
+	if readErr != nil {
+		return readErr
+	}
+	if callResponse.Err != nil {
+		return fmt.Errorf("file upload error: %w", callResponse.Err)
+	}
+
+	var result TransferResult
+	if err = c.decryptJSON(callResponse, &result); err != nil {
+		return err
+	}
+	if err = verifyTransfer(&result, sent, hasher); err != nil {
+		return err
+	}
+
+	progress.Finish()
+	return nil
+}
+
+// Download copies the remote file at remotePath to localPath.
+func (c *FileClient) Download(remotePath, localPath string, opts *TransferOptions) error {
+	// the size is only reported at the end of a download, progress reporting needs it
+	// upfront
+	size := int64(-1)
+	if opts.Progress != nil {
+		if entry, err := c.Stat(remotePath); err == nil {
+			size = entry.Size
+		}
+	}
+
+	return c.download(remotePath, localPath, size, opts)
+}
+
+func (c *FileClient) download(remotePath, localPath string, size int64, opts *TransferOptions) error {
+	var file *os.File
+	var err error
+	if opts.Resume {
+		file, err = os.OpenFile(localPath, os.O_CREATE|os.O_RDWR, 0600)
+	} else {
+		// a new download goes to a temporary file that only replaces localPath once
+		// it is verified, so a failed download leaves the old file intact
+		file, err = createDownloadTemp(localPath)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save file: %w", err)
+	}
+	defer func() {
+		_ = file.Close()
+		if !opts.Resume {
+			_ = os.Remove(file.Name())
+		}
+	}()
+
+	// a resumed download continues after the data that is already present locally
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to save file: %w", err)
+	}
+	offset := info.Size()
+
+	hasher, err := HashPrefix(file, offset)
+	if err != nil {
+		return fmt.Errorf("failed to read local file: %w", err)
+	}
+
+	header, err := c.encryptJSON(&TransferRequest{Path: remotePath, Offset: offset})
+	if err != nil {
+		return err
+	}
+
+	progress := opts.progress()
+	progress.Start(&Transfer{Source: remotePath, Destination: localPath, Size: size, Offset: offset})
+
+	received := offset
+	var writeErr error
+	callResponse := c.session.Call(procedureFileDownload).Arg(header).
+		ProgressReceiver(func(result *xconn.InvocationResult) {
+			if writeErr != nil || len(result.Args) == 0 {
+				return
+			}
+			payload, ok := result.Args[0].([]byte)
+			if !ok {
+				writeErr = fmt.Errorf("invalid chunk from server")
+				return
+			}
+
+			chunk, err := DecryptPayload(payload, c.keys.Receive)
+			if err != nil {
+				writeErr = err
+				return
+			}
+
+			if _, err = file.Write(chunk); err != nil {
+				writeErr = fmt.Errorf("failed to save file: %w", err)
+				return
+			}
+			hasher.Write(chunk)
+			received += int64(len(chunk))
+			progress.Add(len(chunk))
+		}).Do()
+	if callResponse.Err != nil {
+		return fmt.Errorf("file download error: %w", callResponse.Err)
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+
+	var result TransferResult
+	if err = c.decryptJSON(callResponse, &result); err != nil {
+		return err
+	}
+	if err = verifyTransfer(&result, received, hasher); err != nil {
+		return err
+	}
+
+	if err = file.Close(); err != nil {
+		return fmt.Errorf("failed to save file: %w", err)
+	}
+	if !opts.Resume {
+		if err = os.Rename(file.Name(), resolveLink(localPath)); err != nil {
+			return fmt.Errorf("failed to save file: %w", err)
+		}
+	}
+
+	if metadata := opts.metadata(result.Metadata); metadata != nil {
+		if err = metadata.Apply(localPath); err != nil {
+			return err
+		}
+	}
+
+	progress.Finish()
+	return nil
+}
+
+// resolveLink returns the file localPath points to if it is a symlink, a download
+// replaces that file like a truncating write would.
+func resolveLink(localPath string) string {
+	if resolved, err := filepath.EvalSymlinks(localPath); err == nil {
+		return resolved
+	}
+
+	return localPath
+}
+
+// createDownloadTemp creates the temporary file a download to localPath is written
+// to, next to the file it replaces and with the mode of an existing file.
+func createDownloadTemp(localPath string) (*os.File, error) {
+	target := resolveLink(localPath)
+	temp, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".download-*")
+	if err != nil {
+		return nil, err
+	}
+
+	if info, err := os.Stat(target); err == nil {
+		if err = temp.Chmod(info.Mode().Perm()); err != nil {
+			_ = temp.Close()
+			_ = os.Remove(temp.Name())
+			return nil, err
+		}
+	}
+
+	return temp, nil
+}
+
+// UploadTree copies the local tree rooted at localRoot to remoteRoot. Symbolic links
+// are recreated as links instead of being followed, devices, sockets and pipes are
+// skipped.
+func (c *FileClient) UploadTree(localRoot, remoteRoot string, opts *TransferOptions) error {
+	var dirs []*FSRequest
+	err := filepath.WalkDir(localRoot, func(localPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(localRoot, localPath)
+		if err != nil {
+			return err
+		}
+		remotePath := path.Join(remoteRoot, filepath.ToSlash(rel))
+
+		switch {
+		case d.IsDir():
+			if opts.Preserve {
+				info, err := d.Info()
+				if err != nil {
+					return err
+				}
+				dirs = append(dirs, &FSRequest{
+					Path:      remotePath,
+					Recursive: true,
+					Metadata:  opts.metadata(NewFileMetadata(info)),
+				})
+			}
+			return c.Mkdir(remotePath, 0, true)
+		case d.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(localPath)
+			if err != nil {
+				return err
+			}
+			return c.Symlink(remotePath, target)
+		case d.Type().IsRegular():
+			return c.Upload(localPath, remotePath, opts)
+		default:
+			return nil
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// adding entries changes the times of a directory, so the metadata is applied
+	// once the tree is complete, children first
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err = c.call(procedureFSMkdir, dirs[i], nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// localTreePath joins the path of an entry sent by the server to root. It refuses
+// paths that leave root, including through a symlink in root, which an earlier
+// entry may have created.
+func localTreePath(root, entryPath string) (string, error) {
+	rel := filepath.Clean(filepath.FromSlash(entryPath))
+	if !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("invalid path from server: %s", entryPath)
+	}
+
+	parent := root
+	for _, name := range strings.Split(filepath.Dir(rel), string(filepath.Separator)) {
+		if name == "." {
+			break
+		}
+
+		parent = filepath.Join(parent, name)
+		info, err := os.Lstat(parent)
+		if errors.Is(err, fs.ErrNotExist) {
+			break
+		} else if err != nil {
+			return "", err
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return "", fmt.Errorf("refusing to write %s through symlink %s", entryPath, parent)
+		}
+	}
+
+	return filepath.Join(root, rel), nil
+}
+
+// refuseSymlink fails if localPath is a symlink, writing to it would change the
+// file it points to instead.
+func refuseSymlink(localPath string) error {
+	if info, err := os.Lstat(localPath); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+		return fmt.Errorf("refusing to write through symlink %s", localPath)
+	}
+
+	return nil
+}
+
+// DownloadTree copies the remote tree rooted at remoteRoot to localRoot. Entries
+// that would land outside of localRoot, directly or through a symlink, are rejected.
+func (c *FileClient) DownloadTree(remoteRoot, localRoot string, opts *TransferOptions) error {
+	entries, err := c.Walk(remoteRoot)
+	if err != nil {
+		return err
+	}
+
+	var dirs []FileEntry
+	for _, entry := range entries {
+		var localPath string
+		if localPath, err = localTreePath(localRoot, entry.Path); err != nil {
+			return err
+		}
+
+		switch entry.Type {
+		case FileTypeDir:
+			if err = refuseSymlink(localPath); err != nil {
+				return err
+			}
+			if err = os.MkdirAll(localPath, 0700); err != nil {
+				return fmt.Errorf("failed to create directory: %w", err)
+			}
+			dirs = append(dirs, entry)
+		case FileTypeSymlink:
+			if err = os.Remove(localPath); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to replace %s: %w", localPath, err)
+			}
+			if err = os.Symlink(entry.Target, localPath); err != nil {
+				return fmt.Errorf("failed to create symlink: %w", err)
+			}
+		case FileTypeRegular:
+			if err = refuseSymlink(localPath); err != nil {
+				return err
+			}
+			if err = c.download(path.Join(remoteRoot, entry.Path), localPath, entry.Size, opts); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported file type %q for %s", entry.Type, entry.Path)
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if metadata := opts.metadata(dirs[i].Metadata); metadata != nil {
+			// a later entry may have replaced the directory with a symlink
+			localPath := filepath.Join(localRoot, filepath.FromSlash(dirs[i].Path))
+			if err = refuseSymlink(localPath); err != nil {
+				return err
+			}
+			if err = metadata.Apply(localPath); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,664 @@
+package wampshell
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/xconnio/xconn-go"
+)
+
+const (
+	procedureSyncSignature = "wampshell.sync.signature"
+	procedureSyncDelta     = "wampshell.sync.delta"
+	procedureSyncPatch     = "wampshell.sync.patch"
+)
+
+// The actions passed to SyncOptions.Report.
+const (
+	SyncCreate = "create"
+	SyncUpdate = "update"
+	SyncDelete = "delete"
+)
+
+var errSyncAborted = errors.New("sync aborted")
+
+// SyncOptions control SyncUp and SyncDown. Modes and modification times are always
+// preserved because the next sync relies on them to detect changes. Delete removes
+// destination entries that do not exist in the source and allows directories to be
+// replaced, DryRun only reports what would be done. Report is called for every
+// change with one of the Sync actions and the path relative to the roots.
+type SyncOptions struct {
+	TransferOptions
+	Delete bool
+	DryRun bool
+	Report func(action, name string)
+}
+
+// withPreserve returns a copy of o that preserves modes and times. Partial files are
+// never resumed, a changed file is patched instead.
+func (o *SyncOptions) withPreserve() *SyncOptions {
+	opts := *o
+	opts.Preserve, opts.Resume = true, false
+
+	return &opts
+}
+
+// deltaBatch is one encrypted message of a delta upload and the amount of file data
+// it rebuilds.
+type deltaBatch struct {
+	payload []byte
+	size    int64
+}
+
+// opLength returns the amount of data op adds to a file rebuilt against s.
+func (s *Signature) opLength(op DeltaOp) int64 {
+	if op.Count == 0 {
+		return int64(len(op.Data))
+	}
+
+	length := int64(op.Count) * int64(s.BlockSize)
+	if end := int64(op.Block+op.Count) * int64(s.BlockSize); end > s.Size {
+		length -= end - s.Size
+	}
+
+	return length
+}
+
+// uploadDelta updates the remote file at remotePath to the contents of localPath by
+// only sending the blocks the remote file is missing.
+func (c *FileClient) uploadDelta(localPath, remotePath string, opts *TransferOptions) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to open local file: %w", err)
+	}
+	defer func() { _ = file.Close() }()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to open local file: %w", err)
+	}
+
+	var signature Signature
+	if err = c.call(procedureSyncSignature, &FSRequest{Path: remotePath}, &signature); err != nil {
+		return err
+	}
+	if err = signature.Validate(); err != nil {
+		return fmt.Errorf("invalid signature from server: %w", err)
+	}
+
+	// the checksum is sent upfront so that wshd only replaces the remote file if the
+	// rebuilt one is correct
+	hasher, err := HashPrefix(file, info.Size())
+	if err != nil {
+		return fmt.Errorf("failed to read local file: %w", err)
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to read local file: %w", err)
+	}
+
+	stream, err := NewStream(c.keys.Send)
+	if err != nil {
+		return err
+	}
+	header, err := stream.EncryptJSON(&SyncRequest{
+		Path:      remotePath,
+		BlockSize: signature.BlockSize,
+		SHA256:    hex.EncodeToString(hasher.Sum(nil)),
+		Metadata:  opts.metadata(NewFileMetadata(info)),
+	})
+	if err != nil {
+		return err
+	}
+
+	progress := opts.progress()
+	progress.Start(&Transfer{Source: localPath, Destination: remotePath, Upload: true, Size: info.Size()})
+
+	batches := make(chan deltaBatch)
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		defer close(batches)
+		done <- ComputeDelta(file, &signature, func(ops []DeltaOp) error {
+			payload, err := stream.EncryptJSON(ops)
+			if err != nil {
+				return err
+			}
+
+			var size int64
+			for _, op := range ops {
+				size += signature.opLength(op)
+			}
+
+			select {
+			case batches <- deltaBatch{payload: payload, size: size}:
+				return nil
+			case <-stop:
+				return errSyncAborted
+			}
+		})
+	}()
+
+	firstProgress := true
+	var deltaErr error
+	deltaDone := false
+	callResponse := c.session.Call(procedureSyncPatch).
+		ProgressSender(func(ctx context.Context) *xconn.Progress {
+			if firstProgress {
+				firstProgress = false
+				return xconn.NewProgress(header)
+			}
+
+			batch, ok := <-batches
+			if !ok {
+				// batches is closed once the delta is computed, a failed one aborts the
+				// patch instead of completing the file with the delta sent so far
+				deltaErr, deltaDone = <-done, true
+				if deltaErr != nil {
+					return stream.Abort()
+				}
+				return stream.Final()
+			}
+			progress.Add(int(batch.size))
+			return xconn.NewProgress(batch.payload)
+		}).Do()
+	close(stop)
+	if !deltaDone {
+		deltaErr = <-done
+	}
+	if deltaErr != nil && !errors.Is(deltaErr, errSyncAborted) {
+		return fmt.Errorf("failed to compute delta: %w", deltaErr)
+	}
+	if callResponse.Err != nil {
+		return fmt.Errorf("file sync error: %w", callResponse.Err)
+	}
+
+	var result TransferResult
+	if err = c.decryptJSON(callResponse, &result); err != nil {
+		return err
+	}
+	if err = verifyTransfer(&result, info.Size(), hasher); err != nil {
+		return err
+	}
+
+	progress.Finish()
+	return nil
+}
+
+// downloadDelta updates the local file at localPath to the contents of remotePath by
+// only receiving the blocks the local file is missing. The new file is built next to
+// the old one and only replaces it once it is verified.
+func (c *FileClient) downloadDelta(remotePath, localPath string, size int64, opts *TransferOptions) error {
+	base, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to open local file: %w", err)
+	}
+	defer func() { _ = base.Close() }()
+
+	info, err := base.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to open local file: %w", err)
+	}
+
+	signature, err := ComputeSignature(base, info.Size())
+	if err != nil {
+		return fmt.Errorf("failed to read local file: %w", err)
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(localPath), "."+filepath.Base(localPath)+".wsync-*")
+	if err != nil {
+		return fmt.Errorf("failed to save file: %w", err)
+	}
+	defer func() {
+		_ = temp.Close()
+		_ = os.Remove(temp.Name())
+	}()
+
+	stream, err := NewStream(c.keys.Send)
+	if err != nil {
+		return err
+	}
+	header, err := stream.EncryptJSON(&SyncRequest{Path: remotePath, Signature: signature})
+	if err != nil {
+		return err
+	}
+
+	progress := opts.progress()
+	progress.Start(&Transfer{Source: remotePath, Destination: localPath, Size: size})
+
+	hasher := sha256.New()
+	out := io.MultiWriter(temp, hasher)
+	var received int64
+	var writeErr error
+	callResponse := c.session.Call(procedureSyncDelta).Arg(header).
+		ProgressReceiver(func(result *xconn.InvocationResult) {
+			if writeErr != nil || len(result.Args) == 0 {
+				return
+			}
+			payload, ok := result.Args[0].([]byte)
+			if !ok {
+				writeErr = fmt.Errorf("invalid delta from server")
+				return
+			}
+
+			opsJSON, err := DecryptPayload(payload, c.keys.Receive)
+			if err != nil {
+				writeErr = err
+				return
+			}
+
+			var ops []DeltaOp
+			if err = json.Unmarshal(opsJSON, &ops); err != nil {
+				writeErr = fmt.Errorf("invalid delta from server: %w", err)
+				return
+			}
+
+			n, err := ApplyDelta(base, signature.BlockSize, ops, out)
+			received += n
+			progress.Add(int(n))
+			if err != nil {
+				writeErr = fmt.Errorf("failed to save file: %w", err)
+			}
+		}).Do()
+	if callResponse.Err != nil {
+		return fmt.Errorf("file sync error: %w", callResponse.Err)
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+
+	var result TransferResult
+	if err = c.decryptJSON(callResponse, &result); err != nil {
+		return err
+	}
+	if err = verifyTransfer(&result, received, hasher); err != nil {
+		return err
+	}
+
+	if err = temp.Close(); err != nil {
+		return fmt.Errorf("failed to save file: %w", err)
+	}
+	if err = os.Chmod(temp.Name(), info.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to save file: %w", err)
+	}
+	if err = os.Rename(temp.Name(), localPath); err != nil {
+		return fmt.Errorf("failed to save file: %w", err)
+	}
+
+	if metadata := opts.metadata(result.Metadata); metadata != nil {
+		if err = metadata.Apply(localPath); err != nil {
+			return err
+		}
+	}
+
+	progress.Finish()
+	return nil
+}
+
+// syncTarget changes the destination tree of a sync, names are relative to its root.
+type syncTarget interface {
+	remove(name string) error
+	mkdir(name string) error
+	symlink(name, target string) error
+	// copyFile transfers the whole file, patchFile only the changed blocks.
+	copyFile(name string, source *FileEntry) error
+	patchFile(name string, source *FileEntry) error
+	chmod(name string, mode os.FileMode) error
+	setMetadata(name string, metadata *FileMetadata) error
+}
+
+// remoteTarget syncs a local tree to the remote tree at root.
+type remoteTarget struct {
+	client    *FileClient
+	localRoot string
+	root      string
+	opts      *TransferOptions
+}
+
+func (t *remoteTarget) remotePath(name string) string {
+	return path.Join(t.root, name)
+}
+
+func (t *remoteTarget) localPath(name string) string {
+	return filepath.Join(t.localRoot, filepath.FromSlash(name))
+}
+
+func (t *remoteTarget) remove(name string) error {
+	return t.client.Remove(t.remotePath(name), true)
+}
+
+func (t *remoteTarget) mkdir(name string) error {
+	return t.client.Mkdir(t.remotePath(name), 0, true)
+}
+
+func (t *remoteTarget) symlink(name, target string) error {
+	return t.client.Symlink(t.remotePath(name), target)
+}
+
+func (t *remoteTarget) copyFile(name string, _ *FileEntry) error {
+	return t.client.Upload(t.localPath(name), t.remotePath(name), t.opts)
+}
+
+func (t *remoteTarget) patchFile(name string, _ *FileEntry) error {
+	return t.client.uploadDelta(t.localPath(name), t.remotePath(name), t.opts)
+}
+
+func (t *remoteTarget) chmod(name string, mode os.FileMode) error {
+	return t.client.Chmod(t.remotePath(name), mode)
+}
+
+func (t *remoteTarget) setMetadata(name string, metadata *FileMetadata) error {
+	return t.client.call(procedureFSMkdir, &FSRequest{
+		Path:      t.remotePath(name),
+		Recursive: true,
+		Metadata:  metadata,
+	}, nil)
+}
+
+// localTarget syncs a remote tree to the local tree at root.
+type localTarget struct {
+	client     *FileClient
+	remoteRoot string
+	root       string
+	opts       *TransferOptions
+}
+
+func (t *localTarget) remotePath(name string) string {
+	return path.Join(t.remoteRoot, name)
+}
+
+// localPath resolves name below root. It refuses to go through a symlink, which an
+// entry sent by the server may have created to point anywhere.
+func (t *localTarget) localPath(name string) (string, error) {
+	return localTreePath(t.root, name)
+}
+
+// writablePath is localPath for entries that are written in place, which must not
+// be symlinks themselves either.
+func (t *localTarget) writablePath(name string) (string, error) {
+	localPath, err := t.localPath(name)
+	if err != nil {
+		return "", err
+	}
+
+	return localPath, refuseSymlink(localPath)
+}
+
+func (t *localTarget) remove(name string) error {
+	localPath, err := t.localPath(name)
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(localPath)
+}
+
+func (t *localTarget) mkdir(name string) error {
+	localPath, err := t.writablePath(name)
+	if err != nil {
+		return err
+	}
+
+	return os.MkdirAll(localPath, 0700)
+}
+
+func (t *localTarget) symlink(name, target string) error {
+	localPath, err := t.localPath(name)
+	if err != nil {
+		return err
+	}
+
+	return os.Symlink(target, localPath)
+}
+
+func (t *localTarget) copyFile(name string, source *FileEntry) error {
+	localPath, err := t.writablePath(name)
+	if err != nil {
+		return err
+	}
+
+	return t.client.download(t.remotePath(name), localPath, source.Size, t.opts)
+}
+
+func (t *localTarget) patchFile(name string, source *FileEntry) error {
+	localPath, err := t.writablePath(name)
+	if err != nil {
+		return err
+	}
+
+	return t.client.downloadDelta(t.remotePath(name), localPath, source.Size, t.opts)
+}
+
+func (t *localTarget) chmod(name string, mode os.FileMode) error {
+	localPath, err := t.writablePath(name)
+	if err != nil {
+		return err
+	}
+
+	return os.Chmod(localPath, mode)
+}
+
+func (t *localTarget) setMetadata(name string, metadata *FileMetadata) error {
+	localPath, err := t.writablePath(name)
+	if err != nil {
+		return err
+	}
+
+	return metadata.Apply(localPath)
+}
+
+// SyncUp makes the remote tree at remoteRoot a copy of the local tree at localRoot,
+// files that changed are updated by only sending the changed blocks.
+func (c *FileClient) SyncUp(localRoot, remoteRoot string, opts *SyncOptions) error {
+	source, err := WalkTree(localRoot)
+	if err != nil {
+		return err
+	}
+
+	destination, err := c.Walk(remoteRoot)
+	if err != nil && !IsNotFound(err) {
+		return err
+	}
+
+	syncOpts := opts.withPreserve()
+	return synchronize(source, destination, &remoteTarget{
+		client:    c,
+		localRoot: localRoot,
+		root:      remoteRoot,
+		opts:      &syncOpts.TransferOptions,
+	}, syncOpts)
+}
+
+// SyncDown makes the local tree at localRoot a copy of the remote tree at remoteRoot,
+// files that changed are updated by only receiving the changed blocks.
+func (c *FileClient) SyncDown(remoteRoot, localRoot string, opts *SyncOptions) error {
+	source, err := c.Walk(remoteRoot)
+	if err != nil {
+		return err
+	}
+	for _, entry := range source {
+		if !filepath.IsLocal(filepath.FromSlash(entry.Path)) {
+			return fmt.Errorf("invalid path from server: %s", entry.Path)
+		}
+	}
+
+	destination, err := WalkTree(localRoot)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	syncOpts := opts.withPreserve()
+	return synchronize(source, destination, &localTarget{
+		client:     c,
+		remoteRoot: remoteRoot,
+		root:       localRoot,
+		opts:       &syncOpts.TransferOptions,
+	}, syncOpts)
+}
+
+// unchanged reports whether the regular files a and b are considered equal without
+// reading them, which like in rsync is the case if their size and modification time
+// match.
+func unchanged(a, b *FileEntry) bool {
+	if a.Size != b.Size || a.Metadata == nil || b.Metadata == nil {
+		return false
+	}
+
+	return a.Metadata.ModTime.Unix() == b.Metadata.ModTime.Unix()
+}
+
+// modeChanged reports whether the permissions of a and b differ.
+func modeChanged(a, b *FileEntry) bool {
+	return a.Metadata != nil && b.Metadata != nil && a.Metadata.Mode != b.Metadata.Mode
+}
+
+// attributesChanged reports whether the permissions or modification times of a and
+// b differ.
+func attributesChanged(a, b *FileEntry) bool {
+	if a.Metadata == nil || b.Metadata == nil {
+		return true
+	}
+
+	return a.Metadata.Mode != b.Metadata.Mode || a.Metadata.ModTime.Unix() != b.Metadata.ModTime.Unix()
+}
+
+// insideAny reports whether name is below one of dirs.
+func insideAny(name string, dirs map[string]bool) bool {
+	for name != "." {
+		name = path.Dir(name)
+		if dirs[name] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// synchronize applies the changes that turn the destination tree into a copy of the
+// source tree to target. Both trees are listed in walk order, parents first.
+func synchronize(source, destination []FileEntry, target syncTarget, opts *SyncOptions) error {
+	existing := make(map[string]*FileEntry, len(destination))
+	for i := range destination {
+		existing[destination[i].Path] = &destination[i]
+	}
+
+	wanted := make(map[string]bool, len(source))
+	for _, entry := range source {
+		wanted[entry.Path] = true
+	}
+
+	removed := make(map[string]bool)
+	// directories whose entries changed, their times have to be restored afterwards
+	dirty := make(map[string]bool)
+
+	apply := func(action, name string, change func() error) error {
+		if opts.Report != nil {
+			opts.Report(action, name)
+		}
+		dirty[path.Dir(name)] = true
+		if opts.DryRun {
+			return nil
+		}
+
+		return change()
+	}
+
+	remove := func(name string) error {
+		removed[name] = true
+		return apply(SyncDelete, name, func() error { return target.remove(name) })
+	}
+
+	if opts.Delete {
+		for _, entry := range destination {
+			if wanted[entry.Path] || insideAny(entry.Path, removed) {
+				continue
+			}
+			if err := remove(entry.Path); err != nil {
+				return err
+			}
+		}
+	}
+
+	var dirs []*FileEntry
+	for i := range source {
+		entry := &source[i]
+		name := entry.Path
+
+		current, exists := existing[name]
+		if exists && insideAny(name, removed) {
+			exists = false
+		}
+
+		if exists && current.Type != entry.Type {
+			if current.Type == FileTypeDir && !opts.Delete {
+				return fmt.Errorf("cannot replace directory %s with a %s without --delete", name, entry.Type)
+			}
+			if err := remove(name); err != nil {
+				return err
+			}
+			exists = false
+		}
+
+		var err error
+		switch entry.Type {
+		case FileTypeDir:
+			if !exists {
+				err = apply(SyncCreate, name, func() error { return target.mkdir(name) })
+			}
+			if !exists || attributesChanged(current, entry) {
+				dirty[name] = true
+			}
+			dirs = append(dirs, entry)
+		case FileTypeSymlink:
+			if !exists {
+				err = apply(SyncCreate, name, func() error { return target.symlink(name, entry.Target) })
+			} else if current.Target != entry.Target {
+				err = apply(SyncUpdate, name, func() error {
+					if err := target.remove(name); err != nil {
+						return err
+					}
+					return target.symlink(name, entry.Target)
+				})
+			}
+		case FileTypeRegular:
+			switch {
+			case !exists:
+				err = apply(SyncCreate, name, func() error { return target.copyFile(name, entry) })
+			case !unchanged(current, entry):
+				err = apply(SyncUpdate, name, func() error { return target.patchFile(name, entry) })
+			case modeChanged(current, entry):
+				err = apply(SyncUpdate, name, func() error { return target.chmod(name, entry.Metadata.Mode) })
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.DryRun {
+		return nil
+	}
+
+	// adding entries changes the times of a directory, so the metadata is applied
+	// once the tree is complete, children first
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if !dirty[dirs[i].Path] {
+			continue
+		}
+		if metadata := opts.metadata(dirs[i].Metadata); metadata != nil {
+			if err := target.setMetadata(dirs[i].Path, metadata); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
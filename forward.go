@@ -0,0 +1,312 @@
+package wampshell
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/xconnio/xconn-go"
+)
+
+// ProcedureForwardConnect followed by the session id of a client is the procedure
+// that client registers to receive the connections of its remote forwards.
+const ProcedureForwardConnect = "wampshell.forward.connect"
+
+// ForwardRequest opens a forwarded TCP connection to Address, a host:port as
+// understood by net.Dial. To request a remote forward, Address is where wshd
+// listens, and wshd answers with the address it actually listens on.
+type ForwardRequest struct {
+	Address string `json:"address"`
+}
+
+// ForwardConnection is the request wshd sends to the client for a connection that
+// arrived at a remote forward. Listener is the id the client used to request it.
+type ForwardConnection struct {
+	Listener uint64 `json:"listener"`
+	Origin   string `json:"origin"`
+}
+
+// ForwardConn relays conn as a progressive call to procedure, whose handler is a
+// ForwardHandler. Its messages are stream messages with the id of the connection.
+// The first message carries request, after that data is copied in both directions
+// until both sides have closed their end of the connection, an empty body means
+// that no more data follows.
+func ForwardConn(session *xconn.Session, procedure string, keys *KeyPair, id uint64, request []byte,
+	conn net.Conn) error {
+	defer func() { _ = conn.Close() }()
+
+	encrypt := func(body []byte) ([]byte, error) {
+		return EncryptPayload(NewStreamMessage(id, body), keys.Send)
+	}
+
+	header, err := encrypt(request)
+	if err != nil {
+		return err
+	}
+
+	input := make(chan []byte)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		defer close(input)
+		for {
+			buf := make([]byte, 32*1024)
+			n, err := conn.Read(buf)
+			if n > 0 {
+				select {
+				case input <- buf[:n]:
+				case <-stop:
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	remoteClosed := make(chan struct{})
+	firstProgress := true
+	localClosed, remoteDone := false, false
+	var sendErr, writeErr error
+
+	progress := func(body []byte, final bool) *xconn.Progress {
+		payload, err := encrypt(body)
+		if err != nil {
+			sendErr = err
+			return xconn.NewFinalProgress()
+		}
+		if final {
+			return xconn.NewFinalProgress(payload)
+		}
+		return xconn.NewProgress(payload)
+	}
+
+	callResponse := session.Call(procedure).
+		ProgressSender(func(ctx context.Context) *xconn.Progress {
+			if firstProgress {
+				firstProgress = false
+				return xconn.NewProgress(header)
+			}
+
+			if !localClosed {
+				if data, ok := <-input; ok {
+					return progress(data, false)
+				}
+				// an empty body tells the handler that no more data follows
+				localClosed = true
+				return progress(nil, false)
+			}
+
+			// the call ends once both sides have closed their end
+			select {
+			case <-remoteClosed:
+			case <-stop:
+			}
+			return progress(nil, true)
+		}).
+		ProgressReceiver(func(result *xconn.InvocationResult) {
+			if len(result.Args) == 0 {
+				if remoteDone {
+					return
+				}
+				remoteDone = true
+				closeWrite(conn)
+				close(remoteClosed)
+				return
+			}
+			if writeErr != nil {
+				return
+			}
+
+			payload, ok := result.Args[0].([]byte)
+			if !ok {
+				writeErr = fmt.Errorf("invalid payload from peer")
+				return
+			}
+			data, err := DecryptPayload(payload, keys.Receive)
+			if err != nil {
+				writeErr = fmt.Errorf("decryption failed: %w", err)
+				return
+			}
+			_, writeErr = conn.Write(data)
+		}).Do()
+	if callResponse.Err != nil {
+		return callResponse.Err
+	}
+	if sendErr != nil {
+		return sendErr
+	}
+
+	return writeErr
+}
+
+// closeWrite tells the peer of conn that no more data follows, the other direction
+// stays open.
+func closeWrite(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		_ = tcpConn.CloseWrite()
+	}
+}
+
+// ForwardDialer opens the connection described by the request of a forwarded
+// connection of caller.
+type ForwardDialer func(caller uint64, request []byte) (net.Conn, error)
+
+// forwardKey identifies a forwarded connection, the id is chosen by the caller.
+type forwardKey struct {
+	caller uint64
+	id     uint64
+}
+
+// ForwardHandler is the receiving end of ForwardConn, it dials the connection
+// requested by the first message and relays data until the caller ends the call.
+type ForwardHandler struct {
+	keys  func(caller uint64) (*KeyPair, bool)
+	dial  ForwardDialer
+	conns map[forwardKey]net.Conn
+	sync.Mutex
+}
+
+func NewForwardHandler(keys func(caller uint64) (*KeyPair, bool), dial ForwardDialer) *ForwardHandler {
+	return &ForwardHandler{
+		keys:  keys,
+		dial:  dial,
+		conns: make(map[forwardKey]net.Conn),
+	}
+}
+
+// Forget closes all forwarded connections of caller, once its session left nobody
+// ends them anymore.
+func (f *ForwardHandler) Forget(caller uint64) {
+	f.Lock()
+	var conns []net.Conn
+	for key, conn := range f.conns {
+		if key.caller == caller {
+			conns = append(conns, conn)
+			delete(f.conns, key)
+		}
+	}
+	f.Unlock()
+
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+}
+
+func (f *ForwardHandler) closeConn(key forwardKey) {
+	f.Lock()
+	conn, ok := f.conns[key]
+	delete(f.conns, key)
+	f.Unlock()
+
+	if ok {
+		_ = conn.Close()
+	}
+}
+
+// startOutputReader sends what the dialed connection receives as progressive
+// results. An empty progress tells the caller that it was closed.
+func (f *ForwardHandler) startOutputReader(inv *xconn.Invocation, key forwardKey, conn net.Conn, sendKey []byte) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			payload, errEnc := EncryptPayload(buf[:n], sendKey)
+			if errEnc != nil {
+				log.Printf("Encryption failed in forwarded connection for caller %d: %v", key.caller, errEnc)
+				f.closeConn(key)
+				return
+			}
+			if errSend := inv.SendProgress([]any{payload}, nil); errSend != nil {
+				f.closeConn(key)
+				return
+			}
+		}
+		if err != nil {
+			_ = inv.SendProgress(nil, nil)
+			return
+		}
+	}
+}
+
+// parseForwardInvocation decrypts the message of inv.
+func parseForwardInvocation(inv *xconn.Invocation, key []byte) (id uint64, body []byte, err error) {
+	payload, err := inv.ArgBytes(0)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	message, err := DecryptPayload(payload, key)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return ParseStreamMessage(message)
+}
+
+// Handle is the invocation handler of the forwarding procedure. A call without
+// arguments only checks that the procedure is still registered, ForwardConn never
+// ends a connection that way.
+func (f *ForwardHandler) Handle(_ context.Context, inv *xconn.Invocation) *xconn.InvocationResult {
+	if len(inv.Args()) == 0 && !inv.Progress() {
+		return xconn.NewInvocationResult()
+	}
+
+	caller := inv.Caller()
+	keys, ok := f.keys(caller)
+	if !ok {
+		return xconn.NewInvocationError("wamp.error.unavailable", "no encryption key for caller")
+	}
+
+	id, body, err := parseForwardInvocation(inv, keys.Receive)
+	if err != nil {
+		if !inv.Progress() {
+			// the connection a broken final message ends is unknown, rather than
+			// leaking it all connections of the caller are closed
+			log.Printf("Invalid final message from caller %d, closing its forwarded connections", caller)
+			f.Forget(caller)
+		}
+		return xconn.NewInvocationError("wamp.error.invalid_argument", err.Error())
+	}
+	connKey := forwardKey{caller: caller, id: id}
+
+	f.Lock()
+	conn, ok := f.conns[connKey]
+	f.Unlock()
+
+	if !ok {
+		if !inv.Progress() {
+			return xconn.NewInvocationError("wamp.error.invalid_argument", "unknown forwarded connection")
+		}
+
+		conn, err = f.dial(caller, body)
+		if err != nil {
+			return xconn.NewInvocationError("io.xconn.error", err.Error())
+		}
+
+		f.Lock()
+		f.conns[connKey] = conn
+		f.Unlock()
+
+		go f.startOutputReader(inv, connKey, conn, keys.Send)
+		return xconn.NewInvocationError(xconn.ErrNoResult)
+	}
+
+	if inv.Progress() {
+		if len(body) == 0 {
+			// the caller will not send more data, the other side may still answer
+			closeWrite(conn)
+		} else if _, err = conn.Write(body); err != nil {
+			// closing the connection ends the output reader, which tells the caller
+			log.Printf("Failed to write to forwarded connection of caller %d: %v", caller, err)
+			_ = conn.Close()
+		}
+		return xconn.NewInvocationError(xconn.ErrNoResult)
+	}
+
+	f.closeConn(connKey)
+	return xconn.NewInvocationResult()
+}
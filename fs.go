@@ -0,0 +1,101 @@
+package wampshell
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// ErrorNotFound is the error URI returned when the path of a request does not exist.
+const ErrorNotFound = "wampshell.error.not_found"
+
+const (
+	FileTypeRegular = "file"
+	FileTypeDir     = "dir"
+	FileTypeSymlink = "symlink"
+	FileTypeOther   = "other"
+)
+
+// FSRequest is the encrypted argument of the wampshell.fs procedures. Target is
+// the destination of a symlink or rename, Mode the permissions for chmod and mkdir.
+// Recursive makes mkdir create missing parents and remove delete whole trees.
+// Metadata is applied to created directories.
+type FSRequest struct {
+	Path      string        `json:"path"`
+	Target    string        `json:"target,omitempty"`
+	Mode      os.FileMode   `json:"mode,omitempty"`
+	Recursive bool          `json:"recursive,omitempty"`
+	Metadata  *FileMetadata `json:"metadata,omitempty"`
+	// Follow makes stat describe what a symlink at Path points to.
+	Follow bool `json:"follow,omitempty"`
+}
+
+// FileEntry describes a remote file. Entries returned by walk have a Path relative
+// to the walked root, which itself is reported as ".", list returns the names of the
+// directory entries and stat the requested path.
+type FileEntry struct {
+	Path     string        `json:"path"`
+	Type     string        `json:"type"`
+	Size     int64         `json:"size,omitempty"`
+	Target   string        `json:"target,omitempty"`
+	Metadata *FileMetadata `json:"metadata,omitempty"`
+}
+
+// NewFileEntry describes the file at path under the given name.
+func NewFileEntry(path, name string, info fs.FileInfo) (*FileEntry, error) {
+	entry := &FileEntry{Path: name, Metadata: NewFileMetadata(info)}
+	switch {
+	case info.IsDir():
+		entry.Type = FileTypeDir
+	case info.Mode()&fs.ModeSymlink != 0:
+		entry.Type = FileTypeSymlink
+		target, err := os.Readlink(path)
+		if err != nil {
+			return nil, err
+		}
+		entry.Target = target
+	case info.Mode().IsRegular():
+		entry.Type = FileTypeRegular
+		entry.Size = info.Size()
+	default:
+		entry.Type = FileTypeOther
+	}
+
+	return entry, nil
+}
+
+// WalkTree describes the tree below root without following symbolic links. Devices,
+// sockets and pipes are left out because they can not be copied.
+func WalkTree(root string) ([]FileEntry, error) {
+	entries := make([]FileEntry, 0)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		entry, err := NewFileEntry(path, filepath.ToSlash(rel), info)
+		if err != nil {
+			return err
+		}
+		if entry.Type != FileTypeOther {
+			entries = append(entries, *entry)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
@@ -1,7 +1,11 @@
 package wampshell
 
 import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -9,6 +13,7 @@ import (
 
 	berncrypt "github.com/xconnio/berncrypt/go"
 	"github.com/xconnio/wampproto-capnproto/go"
+	"github.com/xconnio/wampproto-go/auth"
 	"github.com/xconnio/xconn-go"
 )
 
@@ -17,6 +22,10 @@ var CapnprotoSerializerSpec = xconn.NewSerializerSpec( //nolint:gochecknoglobals
 	&wampprotocapnp.CapnprotoSerializer{},
 	xconn.SerializerID(wampprotocapnp.CapnprotoSplitSerializerID))
 
+// keyExchangeContext is prepended to every signed key exchange message so the
+// signatures cannot be confused with cryptosign authentication challenges.
+const keyExchangeContext = "wampshell-key-exchange-v1"
+
 func ReadPrivateKeyFromFile() (string, error) {
 	homeDir, err := RealHome()
 	if err != nil {
@@ -57,13 +66,48 @@ func RunningInSnap() bool {
 	return err == nil
 }
 
-func ExchangeKeys(session *xconn.Session) (*KeyPair, error) {
+func ParsePrivateKey(privateKeyHex string) (ed25519.PrivateKey, error) {
+	keyBytes, err := hex.DecodeString(privateKeyHex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %w", err)
+	}
+
+	switch len(keyBytes) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(keyBytes), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(keyBytes), nil
+	default:
+		return nil, fmt.Errorf("invalid private key length: %d", len(keyBytes))
+	}
+}
+
+func keyExchangeMessage(keys ...[]byte) []byte {
+	message := []byte(keyExchangeContext)
+	for _, key := range keys {
+		message = append(message, key...)
+	}
+	return message
+}
+
+// ExchangeKeys sets up the end-to-end encryption keys for session and asks the
+// daemon to act as the local account username.
+func ExchangeKeys(session *xconn.Session, privateKeyHex, username string) (*KeyPair, error) {
+	identity, err := ParsePrivateKey(privateKeyHex)
+	if err != nil {
+		return nil, err
+	}
+
 	publicKey, privateKey, err := berncrypt.CreateX25519KeyPair()
 	if err != nil {
 		return nil, err
 	}
 
-	response := session.Call("wampshell.key.exchange").Arg(publicKey).Do()
+	identityPublicKey := identity.Public().(ed25519.PublicKey)
+	signature := ed25519.Sign(identity, keyExchangeMessage(publicKey, []byte(username)))
+
+	response := session.Call("wampshell.key.exchange").
+		Args(publicKey, []byte(identityPublicKey), signature, username).Do()
 	if response.Err != nil {
 		return nil, response.Err
 	}
@@ -73,6 +117,21 @@ func ExchangeKeys(session *xconn.Session) (*KeyPair, error) {
 		return nil, err
 	}
 
+	hostPublicKey, err := response.Args.Bytes(1)
+	if err != nil {
+		return nil, err
+	}
+
+	hostSignature, err := response.Args.Bytes(2)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(hostPublicKey) != ed25519.PublicKeySize ||
+		!ed25519.Verify(hostPublicKey, keyExchangeMessage(publicKeyPeer, publicKey, identityPublicKey), hostSignature) {
+		return nil, fmt.Errorf("host key signature verification failed")
+	}
+
 	sharedSecret, err := berncrypt.PerformKeyExchange(privateKey, publicKeyPeer)
 	if err != nil {
 		return nil, err
@@ -88,7 +147,55 @@ func ExchangeKeys(session *xconn.Session) (*KeyPair, error) {
 		return nil, err
 	}
 	return &KeyPair{
-		Send:    sendKey,
-		Receive: receiveKey,
+		Send:          sendKey,
+		Receive:       receiveKey,
+		PeerPublicKey: hostPublicKey,
 	}, nil
 }
+
+// Connect opens a session to the wshd at host:port on behalf of the local account
+// username, exchanges the encryption keys and verifies the host key against the
+// known_hosts file. If a master connection to the same target is running, its
+// session is used instead.
+func Connect(ctx context.Context, host, port, username string, strictHostKeyChecking bool) (*xconn.Session,
+	*KeyPair, error) {
+	if path, err := ControlPath(username, host, port); err == nil {
+		if session, keys, err := ConnectControl(ctx, path); err == nil {
+			return session, keys, nil
+		}
+	}
+
+	privateKey, err := ReadPrivateKeyFromFile()
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading private key failed: %w", err)
+	}
+
+	authenticator, err := auth.NewCryptoSignAuthenticator("", privateKey, map[string]any{"user": username})
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating authenticator failed: %w", err)
+	}
+
+	client := xconn.Client{
+		SerializerSpec: CapnprotoSerializerSpec,
+		Authenticator:  authenticator,
+	}
+
+	url := fmt.Sprintf("rs://%s:%s", host, port)
+	session, err := client.Connect(ctx, url, "wampshell")
+	if err != nil {
+		return nil, nil, fmt.Errorf("connection failed: %w", err)
+	}
+
+	keys, err := ExchangeKeys(session, privateKey, username)
+	if err != nil {
+		_ = session.Leave()
+		return nil, nil, fmt.Errorf("key exchange failed: %w", err)
+	}
+
+	if err = VerifyHostKey(net.JoinHostPort(host, port), keys.PeerPublicKey, strictHostKeyChecking); err != nil {
+		_ = session.Leave()
+		return nil, nil, fmt.Errorf("host key verification failed: %w", err)
+	}
+
+	return session, keys, nil
+}
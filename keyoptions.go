@@ -0,0 +1,227 @@
+package wampshell
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+	"time"
+)
+
+// KeyOptions are the OpenSSH style restrictions that may precede a key in an
+// authorized_keys file, e.g.
+//
+//	command="/usr/local/bin/deploy",no-pty,expiry-time="20261231" <hexkey> [realm]
+//
+// A from= restriction can only be checked for clients that connect to wshd
+// directly. Connections that arrive through a router or WebRTC have no address
+// wshd can see, so keys with the restriction are refused for them instead of
+// having the restriction silently ignored.
+type KeyOptions struct {
+	Command    string
+	From       []string
+	NoPTY      bool
+	NoUpload   bool
+	NoDownload bool
+	// NoPortForwarding refuses local, remote and dynamic forwards, each of which lets
+	// the key open connections on the network of the host.
+	NoPortForwarding bool
+	// PermitOpen restricts forwarded connections to these host:port destinations,
+	// either of which may be *.
+	PermitOpen []string
+	ExpiryTime time.Time
+}
+
+// Valid reports why a key can not be used at the moment, if at all.
+func (o *KeyOptions) Valid(now time.Time) error {
+	if o == nil {
+		return nil
+	}
+
+	if !o.ExpiryTime.IsZero() && now.After(o.ExpiryTime) {
+		return fmt.Errorf("key expired at %s", o.ExpiryTime.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// AllowsSource checks the from= restriction against the address the client
+// connected from, nil if that is unknown. Like OpenSSH with UseDNS=no the patterns
+// are matched against the address only, a leading ! excludes the matching
+// addresses and patterns may be networks in CIDR notation.
+func (o *KeyOptions) AllowsSource(addr net.IP) error {
+	if o == nil || len(o.From) == 0 {
+		return nil
+	}
+
+	if addr == nil {
+		return fmt.Errorf("from= restriction can not be verified, client address unknown")
+	}
+
+	allowed := false
+	for _, pattern := range o.From {
+		negated := strings.HasPrefix(pattern, "!")
+		if !matchSource(strings.TrimPrefix(pattern, "!"), addr) {
+			continue
+		}
+		if negated {
+			return fmt.Errorf("address %s is excluded by from= restriction", addr)
+		}
+		allowed = true
+	}
+
+	if !allowed {
+		return fmt.Errorf("address %s is not allowed by from= restriction", addr)
+	}
+
+	return nil
+}
+
+func matchSource(pattern string, addr net.IP) bool {
+	if _, network, err := net.ParseCIDR(pattern); err == nil {
+		return network.Contains(addr)
+	}
+
+	matched, err := path.Match(pattern, addr.String())
+	return err == nil && matched
+}
+
+// AllowsPTY reports whether interactive shells and PTY exec are permitted.
+func (o *KeyOptions) AllowsPTY() bool {
+	return o == nil || !o.NoPTY
+}
+
+// AllowsUpload reports whether files may be written. A forced command restricts a
+// key to that command only, so it rules out file transfers as well.
+func (o *KeyOptions) AllowsUpload() bool {
+	return o == nil || (!o.NoUpload && o.Command == "")
+}
+
+func (o *KeyOptions) AllowsDownload() bool {
+	return o == nil || (!o.NoDownload && o.Command == "")
+}
+
+// AllowsPortForwarding reports whether TCP connections may be forwarded, which like
+// file transfers is ruled out by a forced command.
+func (o *KeyOptions) AllowsPortForwarding() bool {
+	return o == nil || (!o.NoPortForwarding && o.Command == "")
+}
+
+// AllowsOpen reports whether a forwarded connection to address, host:port, is
+// permitted. Without permitopen= options any destination is. Like in OpenSSH host
+// names are compared as given, without resolving them.
+func (o *KeyOptions) AllowsOpen(address string) bool {
+	if o == nil || len(o.PermitOpen) == 0 {
+		return true
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+
+	for _, permitted := range o.PermitOpen {
+		permittedHost, permittedPort, err := net.SplitHostPort(permitted)
+		if err != nil {
+			continue
+		}
+		if (permittedHost == "*" || strings.EqualFold(permittedHost, host)) &&
+			(permittedPort == "*" || permittedPort == port) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// splitKeyOptions separates the leading options from the rest of an authorized_keys
+// line. Options end at the first whitespace outside of double quotes.
+func splitKeyOptions(line string) (options, rest string) {
+	inQuotes := false
+	for i, c := range line {
+		switch {
+		case c == '"':
+			inQuotes = !inQuotes
+		case (c == ' ' || c == '\t') && !inQuotes:
+			return line[:i], strings.TrimSpace(line[i:])
+		}
+	}
+
+	return line, ""
+}
+
+func parseKeyOptions(options string) (*KeyOptions, error) {
+	keyOptions := &KeyOptions{}
+
+	var fields []string
+	inQuotes := false
+	start := 0
+	for i, c := range options {
+		switch {
+		case c == '"':
+			inQuotes = !inQuotes
+		case c == ',' && !inQuotes:
+			fields = append(fields, options[start:i])
+			start = i + 1
+		}
+	}
+	if inQuotes {
+		return nil, fmt.Errorf("unterminated quote in options")
+	}
+	fields = append(fields, options[start:])
+
+	for _, field := range fields {
+		name, value, hasValue := strings.Cut(field, "=")
+		name = strings.ToLower(name)
+		if hasValue {
+			if len(value) < 2 || !strings.HasPrefix(value, `"`) || !strings.HasSuffix(value, `"`) {
+				return nil, fmt.Errorf("value of option %s must be quoted", name)
+			}
+			value = value[1 : len(value)-1]
+		}
+
+		switch {
+		case name == "command" && hasValue:
+			keyOptions.Command = value
+		case name == "from" && hasValue:
+			keyOptions.From = strings.Split(value, ",")
+		case name == "permitopen" && hasValue:
+			if _, _, err := net.SplitHostPort(value); err != nil {
+				return nil, fmt.Errorf("invalid permitopen %q: %w", value, err)
+			}
+			keyOptions.PermitOpen = append(keyOptions.PermitOpen, value)
+		case name == "expiry-time" && hasValue:
+			expiry, err := parseExpiryTime(value)
+			if err != nil {
+				return nil, err
+			}
+			keyOptions.ExpiryTime = expiry
+		case name == "no-pty" && !hasValue:
+			keyOptions.NoPTY = true
+		case name == "no-upload" && !hasValue:
+			keyOptions.NoUpload = true
+		case name == "no-download" && !hasValue:
+			keyOptions.NoDownload = true
+		case name == "no-port-forwarding" && !hasValue:
+			keyOptions.NoPortForwarding = true
+		default:
+			return nil, fmt.Errorf("unsupported option %q", field)
+		}
+	}
+
+	return keyOptions, nil
+}
+
+// parseExpiryTime accepts the OpenSSH YYYYMMDD[HHMM[SS]] format in local time.
+func parseExpiryTime(value string) (time.Time, error) {
+	for _, layout := range []string{"20060102", "200601021504", "20060102150405"} {
+		if len(value) != len(layout) {
+			continue
+		}
+		if expiry, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return expiry, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid expiry-time %q", value)
+}
@@ -0,0 +1,169 @@
+package wampshell_test
+
+import (
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/xconnio/wampshell"
+)
+
+func TestParseKeyOptions(t *testing.T) {
+	tests := []struct {
+		options string
+		want    wampshell.KeyOptions
+		invalid bool
+	}{
+		{options: "no-pty", want: wampshell.KeyOptions{NoPTY: true}},
+		{
+			options: "NO-UPLOAD,no-download,no-port-forwarding",
+			want:    wampshell.KeyOptions{NoUpload: true, NoDownload: true, NoPortForwarding: true},
+		},
+		{
+			options: `command="echo a, b",no-pty`,
+			want:    wampshell.KeyOptions{Command: "echo a, b", NoPTY: true},
+		},
+		{
+			options: `from="10.0.0.0/8,!10.1.*"`,
+			want:    wampshell.KeyOptions{From: []string{"10.0.0.0/8", "!10.1.*"}},
+		},
+		{
+			options: `expiry-time="20261231"`,
+			want:    wampshell.KeyOptions{ExpiryTime: time.Date(2026, 12, 31, 0, 0, 0, 0, time.Local)},
+		},
+		{
+			options: `expiry-time="202612311530"`,
+			want:    wampshell.KeyOptions{ExpiryTime: time.Date(2026, 12, 31, 15, 30, 0, 0, time.Local)},
+		},
+		{options: `expiry-time="20261231153045"`, want: wampshell.KeyOptions{
+			ExpiryTime: time.Date(2026, 12, 31, 15, 30, 45, 0, time.Local),
+		}},
+		{
+			options: `permitopen="localhost:80",permitopen="*:443",permitopen="[::1]:*"`,
+			want:    wampshell.KeyOptions{PermitOpen: []string{"localhost:80", "*:443", "[::1]:*"}},
+		},
+		{options: `permitopen="localhost"`, invalid: true},
+		{options: `expiry-time="2026-12-31"`, invalid: true},
+		{options: `command=echo`, invalid: true},
+		{options: `command="echo`, invalid: true},
+		{options: `no-pty="yes"`, invalid: true},
+		{options: `command`, invalid: true},
+		{options: `agent-forwarding`, invalid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.options, func(t *testing.T) {
+			got, err := wampshell.ParseKeyOptions(tt.options)
+			if tt.invalid {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got.Command != tt.want.Command || got.NoPTY != tt.want.NoPTY || got.NoUpload != tt.want.NoUpload ||
+				got.NoDownload != tt.want.NoDownload || got.NoPortForwarding != tt.want.NoPortForwarding ||
+				!slices.Equal(got.From, tt.want.From) || !slices.Equal(got.PermitOpen, tt.want.PermitOpen) ||
+				!got.ExpiryTime.Equal(tt.want.ExpiryTime) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyOptionsValid(t *testing.T) {
+	var unrestricted *wampshell.KeyOptions
+	if err := unrestricted.Valid(time.Now()); err != nil {
+		t.Fatalf("unexpected error without options: %v", err)
+	}
+
+	expiry := time.Date(2026, 12, 31, 0, 0, 0, 0, time.UTC)
+	options := &wampshell.KeyOptions{ExpiryTime: expiry}
+	if err := options.Valid(expiry.Add(-time.Second)); err != nil {
+		t.Fatalf("unexpected error before the expiry time: %v", err)
+	}
+	if err := options.Valid(expiry.Add(time.Second)); err == nil {
+		t.Fatal("expected an error after the expiry time")
+	}
+}
+
+func TestKeyOptionsAllowsSource(t *testing.T) {
+	tests := []struct {
+		from    []string
+		addr    string
+		allowed bool
+	}{
+		{from: nil, addr: "192.0.2.1", allowed: true},
+		{from: nil, addr: "", allowed: true},
+		{from: []string{"192.0.2.1"}, addr: "192.0.2.1", allowed: true},
+		{from: []string{"192.0.2.1"}, addr: "192.0.2.10"},
+		{from: []string{"192.0.2.*"}, addr: "192.0.2.10", allowed: true},
+		{from: []string{"192.0.2.?"}, addr: "192.0.2.10"},
+		{from: []string{"192.0.2.0/24"}, addr: "192.0.2.200", allowed: true},
+		{from: []string{"192.0.2.0/24"}, addr: "198.51.100.1"},
+		{from: []string{"192.0.2.0/24", "!192.0.2.13"}, addr: "192.0.2.12", allowed: true},
+		{from: []string{"192.0.2.0/24", "!192.0.2.13"}, addr: "192.0.2.13"},
+		{from: []string{"!192.0.2.13", "192.0.2.0/24"}, addr: "192.0.2.13"},
+		{from: []string{"!192.0.2.13"}, addr: "192.0.2.12"},
+		{from: []string{"2001:db8::/32"}, addr: "2001:db8::1", allowed: true},
+		{from: []string{"2001:db8::/32"}, addr: "192.0.2.1"},
+		{from: []string{"*"}, addr: "2001:db8::1", allowed: true},
+		// the address of a client that is not connected directly is unknown
+		{from: []string{"*"}, addr: ""},
+	}
+
+	for _, tt := range tests {
+		options := &wampshell.KeyOptions{From: tt.from}
+		err := options.AllowsSource(net.ParseIP(tt.addr))
+		if tt.allowed && err != nil {
+			t.Errorf("from=%q refused %q: %v", tt.from, tt.addr, err)
+		}
+		if !tt.allowed && err == nil {
+			t.Errorf("from=%q allowed %q", tt.from, tt.addr)
+		}
+	}
+}
+
+func TestKeyOptionsAllows(t *testing.T) {
+	var unrestricted *wampshell.KeyOptions
+	if !unrestricted.AllowsPTY() || !unrestricted.AllowsUpload() || !unrestricted.AllowsDownload() ||
+		!unrestricted.AllowsPortForwarding() {
+		t.Fatal("a key without options must allow everything")
+	}
+
+	command := &wampshell.KeyOptions{Command: "true"}
+	if !command.AllowsPTY() || command.AllowsUpload() || command.AllowsDownload() || command.AllowsPortForwarding() {
+		t.Fatal("a forced command must only allow running it")
+	}
+}
+
+func TestKeyOptionsAllowsOpen(t *testing.T) {
+	tests := []struct {
+		permitOpen []string
+		address    string
+		allowed    bool
+	}{
+		{permitOpen: nil, address: "example.com:22", allowed: true},
+		{permitOpen: []string{"localhost:80"}, address: "localhost:80", allowed: true},
+		{permitOpen: []string{"localhost:80"}, address: "LOCALHOST:80", allowed: true},
+		{permitOpen: []string{"localhost:80"}, address: "localhost:81"},
+		{permitOpen: []string{"localhost:80"}, address: "127.0.0.1:80"},
+		{permitOpen: []string{"*:443"}, address: "example.com:443", allowed: true},
+		{permitOpen: []string{"*:443"}, address: "example.com:80"},
+		{permitOpen: []string{"db:*"}, address: "db:5432", allowed: true},
+		{permitOpen: []string{"[::1]:22"}, address: "[::1]:22", allowed: true},
+		{permitOpen: []string{"localhost:80", "db:5432"}, address: "db:5432", allowed: true},
+		{permitOpen: []string{"*:*"}, address: "example.com"},
+	}
+
+	for _, tt := range tests {
+		options := &wampshell.KeyOptions{PermitOpen: tt.permitOpen}
+		if allowed := options.AllowsOpen(tt.address); allowed != tt.allowed {
+			t.Errorf("permitopen=%q allows %q: %v, want %v", tt.permitOpen, tt.address, allowed, tt.allowed)
+		}
+	}
+}
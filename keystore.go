@@ -8,19 +8,22 @@ import (
 	"slices"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 )
 
 type KeyStore struct {
 	keys     map[string][]string
+	options  map[string]*KeyOptions
 	onUpdate func(map[string][]string)
 	sync.RWMutex
 }
 
 func NewKeyStore() *KeyStore {
 	return &KeyStore{
-		keys: make(map[string][]string),
+		keys:    make(map[string][]string),
+		options: make(map[string]*KeyOptions),
 	}
 }
 
@@ -33,7 +36,28 @@ func (k *KeyStore) HasKey(realm, key string) bool {
 		return false
 	}
 
-	return slices.Contains(keys, key)
+	return slices.Contains(keys, key) && k.options[key].Valid(time.Now()) == nil
+}
+
+func (k *KeyStore) HasPublicKey(key string) bool {
+	k.RLock()
+	defer k.RUnlock()
+
+	for _, keys := range k.keys {
+		if slices.Contains(keys, key) {
+			return k.options[key].Valid(time.Now()) == nil
+		}
+	}
+
+	return false
+}
+
+// Options returns the restrictions of key, nil if it has none.
+func (k *KeyStore) Options(key string) *KeyOptions {
+	k.RLock()
+	defer k.RUnlock()
+
+	return k.options[key]
 }
 
 func (k *KeyStore) OnUpdate(cb func(map[string][]string)) {
@@ -42,39 +66,83 @@ func (k *KeyStore) OnUpdate(cb func(map[string][]string)) {
 	k.onUpdate = cb
 }
 
-func (k *KeyStore) Update(keys map[string][]string) {
+func (k *KeyStore) Update(keys map[string][]string, options map[string]*KeyOptions) {
 	k.Lock()
 	defer k.Unlock()
 	k.keys = keys
+	k.options = options
 	if k.onUpdate != nil {
 		go k.onUpdate(keys)
 	}
 }
 
-func readKeys(filePath string) (map[string][]string, error) {
-	keys := make(map[string][]string)
-
+func readKeys(filePath string) (map[string][]string, map[string]*KeyOptions, error) {
 	if err := os.MkdirAll(filepath.Dir(filePath), 0700); err != nil {
-		return nil, fmt.Errorf("failed to create directory: %w", err)
+		return nil, nil, fmt.Errorf("failed to create directory: %w", err)
 	}
 
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
 		if err := os.WriteFile(filePath, []byte(""), 0600); err != nil {
-			return nil, fmt.Errorf("failed to create file %s: %w", filePath, err)
+			return nil, nil, fmt.Errorf("failed to create file %s: %w", filePath, err)
 		}
 	}
 
 	data, err := os.ReadFile(filePath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read %s: %w", filePath, err)
+		return nil, nil, fmt.Errorf("failed to read %s: %w", filePath, err)
+	}
+
+	keys, options := parseKeys(data)
+	return keys, options, nil
+}
+
+// userKeyOptions checks a user's own authorized_keys file, which unlike the daemon's
+// file is never created or watched.
+func userKeyOptions(filePath, key string) (*KeyOptions, bool) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, false
 	}
 
+	keys, options := parseKeys(data)
+	for _, realmKeys := range keys {
+		if slices.Contains(realmKeys, key) {
+			return options[key], options[key].Valid(time.Now()) == nil
+		}
+	}
+
+	return nil, false
+}
+
+// parseKeys reads the keys of an authorized_keys file by realm. A key may be listed
+// once per realm, but its options apply to all of them, so a key that is listed with
+// different options is refused rather than picking one of them.
+func parseKeys(data []byte) (map[string][]string, map[string]*KeyOptions) {
+	keys := make(map[string][]string)
+	options := make(map[string]*KeyOptions)
+	optionStrings := make(map[string]string)
+	conflicts := make(map[string]bool)
+
 	for _, keyWithRealm := range strings.Split(string(data), "\n") {
 		keyWithRealm = strings.TrimSpace(keyWithRealm)
-		if keyWithRealm == "" {
+		if keyWithRealm == "" || strings.HasPrefix(keyWithRealm, "#") {
 			continue
 		}
 
+		var keyOptions *KeyOptions
+		var optionsString string
+		if !isHexKey(strings.Fields(keyWithRealm)[0]) {
+			var rest string
+			optionsString, rest = splitKeyOptions(keyWithRealm)
+
+			var err error
+			keyOptions, err = parseKeyOptions(optionsString)
+			if err != nil || rest == "" {
+				continue
+			}
+			keyWithRealm = rest
+		}
+
 		parts := strings.Fields(keyWithRealm)
 		keyHex := strings.TrimSpace(parts[0])
 
@@ -88,22 +156,45 @@ func readKeys(filePath string) (map[string][]string, error) {
 			realm = strings.TrimSpace(parts[1])
 		}
 
+		if previous, ok := optionStrings[parts[0]]; ok && previous != optionsString {
+			conflicts[parts[0]] = true
+		}
+		optionStrings[parts[0]] = optionsString
+
 		if keys[realm] == nil {
 			keys[realm] = make([]string, 0)
 		}
 
 		keys[realm] = append(keys[realm], parts[0])
+		if keyOptions != nil {
+			options[parts[0]] = keyOptions
+		}
+	}
+
+	for key := range conflicts {
+		for realm := range keys {
+			keys[realm] = slices.DeleteFunc(keys[realm], func(k string) bool { return k == key })
+			if len(keys[realm]) == 0 {
+				delete(keys, realm)
+			}
+		}
+		delete(options, key)
 	}
 
-	return keys, nil
+	return keys, options
+}
+
+func isHexKey(field string) bool {
+	keyBytes, err := hex.DecodeString(field)
+	return err == nil && len(keyBytes) == 32
 }
 
 func (k *KeyStore) Watch(filePath string) (*fsnotify.Watcher, error) {
-	keys, err := readKeys(filePath)
+	keys, options, err := readKeys(filePath)
 	if err != nil {
 		return nil, err
 	}
-	k.Update(keys)
+	k.Update(keys, options)
 
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -131,14 +222,14 @@ func (k *KeyStore) watch(filePath string, watcher *fsnotify.Watcher) {
 
 		switch {
 		case event.Has(fsnotify.Write), event.Has(fsnotify.Create):
-			keys, err := readKeys(filePath)
+			keys, options, err := readKeys(filePath)
 			if err != nil {
 				continue
 			}
-			k.Update(keys)
+			k.Update(keys, options)
 
 		case event.Has(fsnotify.Remove), event.Has(fsnotify.Rename):
-			k.Update(make(map[string][]string))
+			k.Update(make(map[string][]string), make(map[string]*KeyOptions))
 		}
 	}
 }
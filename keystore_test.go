@@ -0,0 +1,92 @@
+package wampshell_test
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/xconnio/wampshell"
+)
+
+const (
+	testKey      = "0101010101010101010101010101010101010101010101010101010101010101"
+	otherTestKey = "0202020202020202020202020202020202020202020202020202020202020202"
+)
+
+func TestParseKeys(t *testing.T) {
+	data := strings.Join([]string{
+		"# comment",
+		"",
+		testKey,
+		"no-pty " + otherTestKey + " other",
+		"not-a-key",
+		"0102",
+		"unknown-option " + testKey,
+	}, "\n")
+
+	keys, options := wampshell.ParseKeys([]byte(data))
+	if !slices.Equal(keys["wampshell"], []string{testKey}) {
+		t.Fatalf("keys of realm wampshell are %q", keys["wampshell"])
+	}
+	if !slices.Equal(keys["other"], []string{otherTestKey}) {
+		t.Fatalf("keys of realm other are %q", keys["other"])
+	}
+	if options[testKey] != nil {
+		t.Fatalf("unexpected options %+v", options[testKey])
+	}
+	if options[otherTestKey] == nil || !options[otherTestKey].NoPTY {
+		t.Fatalf("options of %s are %+v", otherTestKey, options[otherTestKey])
+	}
+}
+
+func TestParseKeysDuplicates(t *testing.T) {
+	tests := []struct {
+		name     string
+		lines    []string
+		accepted bool
+	}{
+		{
+			name:     "same options in two realms",
+			lines:    []string{"no-pty " + testKey + " one", "no-pty " + testKey + " two"},
+			accepted: true,
+		},
+		{
+			name:     "no options in two realms",
+			lines:    []string{testKey + " one", testKey + " two"},
+			accepted: true,
+		},
+		{
+			name:  "restricted then unrestricted",
+			lines: []string{"no-pty " + testKey, testKey + " other"},
+		},
+		{
+			name:  "unrestricted then restricted",
+			lines: []string{testKey, "no-pty " + testKey + " other"},
+		},
+		{
+			name:  "different restrictions",
+			lines: []string{`from="192.0.2.1" ` + testKey, "no-pty " + testKey},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := strings.Join(append(tt.lines, otherTestKey), "\n")
+			keys, options := wampshell.ParseKeys([]byte(data))
+
+			found := false
+			for _, realmKeys := range keys {
+				found = found || slices.Contains(realmKeys, testKey)
+			}
+			if found != tt.accepted {
+				t.Fatalf("key accepted: %v, want %v", found, tt.accepted)
+			}
+			if !tt.accepted && options[testKey] != nil {
+				t.Fatalf("options of a refused key were kept: %+v", options[testKey])
+			}
+			if !slices.Contains(keys["wampshell"], otherTestKey) {
+				t.Fatal("the other key was refused as well")
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package wampshell
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	ErrHostKeyMismatch = errors.New("host key mismatch")
+	ErrHostKeyUnknown  = errors.New("host key unknown")
+)
+
+func KnownHostsPath() (string, error) {
+	homeDir, err := RealHome()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(homeDir, ".wampshell", "known_hosts"), nil
+}
+
+func readKnownHosts(filePath string) (map[string]string, error) {
+	hosts := make(map[string]string)
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return hosts, nil
+		}
+		return nil, fmt.Errorf("failed to read %s: %w", filePath, err)
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.Fields(line)
+		if len(parts) < 2 {
+			continue
+		}
+
+		hosts[parts[0]] = parts[1]
+	}
+
+	return hosts, nil
+}
+
+func addKnownHost(filePath, host, key string) error {
+	if err := os.MkdirAll(filepath.Dir(filePath), 0700); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", filePath, err)
+	}
+	defer func() { _ = file.Close() }()
+
+	if _, err = fmt.Fprintf(file, "%s %s\n", host, key); err != nil {
+		return fmt.Errorf("failed to write %s: %w", filePath, err)
+	}
+
+	return nil
+}
+
+// confirmHostKey asks the user whether to trust an unknown host. The terminal is
+// used directly because stdin may carry data meant for the remote command.
+func confirmHostKey(host, key string) (bool, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return false, fmt.Errorf("cannot prompt for host key confirmation: %w", err)
+	}
+	defer func() { _ = tty.Close() }()
+
+	_, _ = fmt.Fprintf(tty, "The authenticity of host '%s' can't be established.\n", host)
+	_, _ = fmt.Fprintf(tty, "ed25519 host key is %s.\n", key)
+	_, _ = fmt.Fprint(tty, "Are you sure you want to continue connecting (yes/no)? ")
+
+	answer, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil {
+		return false, err
+	}
+	answer = strings.TrimSpace(strings.ToLower(answer))
+
+	return answer == "y" || answer == "yes", nil
+}
+
+// VerifyHostKey checks the host key presented during key exchange against the
+// known_hosts file. Unknown hosts are trusted on first use after confirmation,
+// unless strict is set, in which case they are rejected.
+func VerifyHostKey(host string, hostKey []byte, strict bool) error {
+	filePath, err := KnownHostsPath()
+	if err != nil {
+		return err
+	}
+
+	hosts, err := readKnownHosts(filePath)
+	if err != nil {
+		return err
+	}
+
+	key := hex.EncodeToString(hostKey)
+	knownKey, ok := hosts[host]
+	if ok {
+		if knownKey != key {
+			return fmt.Errorf("%w for %s: expected %s, got %s (remove the entry from %s if the host key "+
+				"was changed intentionally)", ErrHostKeyMismatch, host, knownKey, key, filePath)
+		}
+		return nil
+	}
+
+	if strict {
+		return fmt.Errorf("%w for %s and strict host key checking is enabled", ErrHostKeyUnknown, host)
+	}
+
+	confirmed, err := confirmHostKey(host, key)
+	if err != nil {
+		return err
+	}
+	if !confirmed {
+		return fmt.Errorf("%w for %s: verification declined", ErrHostKeyUnknown, host)
+	}
+
+	if err = addKnownHost(filePath, host, key); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Permanently added '%s' to the list of known hosts.\n", host)
+
+	return nil
+}
@@ -0,0 +1,219 @@
+package wampshell
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/xconnio/wampproto-go/auth"
+	"github.com/xconnio/xconn-go"
+)
+
+const (
+	rawSocketMagic = 0x7F
+	// rawSocketMaxLength announces the largest message accepted, 2^(9+15) bytes,
+	// which is every length the 3 byte frame header can hold. The signature of a
+	// large file that a sync download sends can come close to it.
+	rawSocketMaxLength = 0x0F
+	rawSocketMaxFrame  = 1 << (9 + rawSocketMaxLength)
+	// rawSocketHandshakeFrame is the largest message accepted before the client is
+	// authenticated, which is plenty for HELLO and AUTHENTICATE.
+	rawSocketHandshakeFrame = 64 * 1024
+
+	rawSocketErrorSerializer    = 1
+	rawSocketHandshakeTimeout   = 30 * time.Second
+	rawSocketAcceptRetryBackoff = 100 * time.Millisecond
+
+	rawSocketMessage = 0
+	rawSocketPing    = 1
+	rawSocketPong    = 2
+)
+
+// rawSocketPeer is a WAMP rawsocket connection to a client, framing messages as
+// described in the WAMP specification.
+type rawSocketPeer struct {
+	conn net.Conn
+	// maxLength is the largest message the client accepts
+	maxLength int
+	// readLimit is the largest message read from the client, larger frames are
+	// refused before their payload is allocated
+	readLimit int
+	sync.Mutex
+}
+
+// acceptRawSocket performs the rawsocket handshake on conn, only the capnproto
+// serializer is accepted. Messages of the client are limited to readLimit bytes
+// until the limit is raised.
+func acceptRawSocket(conn net.Conn, readLimit int) (*rawSocketPeer, error) {
+	var handshake [4]byte
+	if _, err := io.ReadFull(conn, handshake[:]); err != nil {
+		return nil, err
+	}
+	if handshake[0] != rawSocketMagic {
+		return nil, fmt.Errorf("not a rawsocket client")
+	}
+
+	serializer := handshake[1] & 0x0F
+	if serializer != byte(CapnprotoSerializerSpec.SerializerID()) {
+		_, _ = conn.Write([]byte{rawSocketMagic, rawSocketErrorSerializer << 4, 0, 0})
+		return nil, fmt.Errorf("unsupported serializer %d", serializer)
+	}
+
+	if _, err := conn.Write([]byte{rawSocketMagic, rawSocketMaxLength<<4 | serializer, 0, 0}); err != nil {
+		return nil, err
+	}
+
+	return &rawSocketPeer{conn: conn, maxLength: 1 << (9 + int(handshake[1]>>4)), readLimit: readLimit}, nil
+}
+
+func (p *rawSocketPeer) Type() xconn.TransportType {
+	return xconn.TransportNone
+}
+
+func (p *rawSocketPeer) NetConn() net.Conn {
+	return p.conn
+}
+
+// Read returns the next message of the client and answers pings on the way.
+func (p *rawSocketPeer) Read() ([]byte, error) {
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(p.conn, header[:]); err != nil {
+			return nil, err
+		}
+
+		length := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+		if length > p.readLimit {
+			return nil, fmt.Errorf("message of %d bytes exceeds the limit of %d bytes", length, p.readLimit)
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(p.conn, payload); err != nil {
+			return nil, err
+		}
+
+		switch frameType := header[0] & 0x07; frameType {
+		case rawSocketMessage:
+			return payload, nil
+		case rawSocketPing:
+			if err := p.write(rawSocketPong, payload); err != nil {
+				return nil, err
+			}
+		case rawSocketPong:
+		default:
+			return nil, fmt.Errorf("invalid rawsocket frame type %d", frameType)
+		}
+	}
+}
+
+func (p *rawSocketPeer) Write(data []byte) error {
+	return p.write(rawSocketMessage, data)
+}
+
+func (p *rawSocketPeer) write(frameType byte, data []byte) error {
+	if len(data) > p.maxLength {
+		return fmt.Errorf("message of %d bytes exceeds the limit of the client", len(data))
+	}
+
+	frame := make([]byte, 4+len(data))
+	frame[0] = frameType
+	frame[1], frame[2], frame[3] = byte(len(data)>>16), byte(len(data)>>8), byte(len(data))
+	copy(frame[4:], data)
+
+	p.Lock()
+	defer p.Unlock()
+	_, err := p.conn.Write(frame)
+	return err
+}
+
+// RawSocketServer accepts WAMP rawsocket clients and attaches them to a router.
+// Unlike xconn.Server it reports every session that joins, with the connection it
+// came from, and every session that leaves.
+type RawSocketServer struct {
+	router        *xconn.Router
+	authenticator auth.ServerAuthenticator
+	onJoin        func(sessionID uint64, addr net.Addr)
+	onLeave       func(sessionID uint64)
+}
+
+// NewRawSocketServer creates a server for router, authenticator may be nil to
+// accept anonymous clients.
+func NewRawSocketServer(router *xconn.Router, authenticator auth.ServerAuthenticator,
+	onJoin func(sessionID uint64, addr net.Addr), onLeave func(sessionID uint64)) *RawSocketServer {
+	return &RawSocketServer{
+		router:        router,
+		authenticator: authenticator,
+		onJoin:        onJoin,
+		onLeave:       onLeave,
+	}
+}
+
+// Serve accepts clients on listener until it is closed.
+func (s *RawSocketServer) Serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			log.Printf("failed to accept connection: %v", err)
+			time.Sleep(rawSocketAcceptRetryBackoff)
+			continue
+		}
+
+		go func() {
+			if err := s.serveClient(conn); err != nil {
+				log.Printf("connection from %s: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+func (s *RawSocketServer) serveClient(conn net.Conn) error {
+	defer func() { _ = conn.Close() }()
+
+	// a client has to finish the handshake and authentication in time
+	_ = conn.SetDeadline(time.Now().Add(rawSocketHandshakeTimeout))
+
+	peer, err := acceptRawSocket(conn, rawSocketHandshakeFrame)
+	if err != nil {
+		return err
+	}
+
+	serializer := CapnprotoSerializerSpec.Serializer()
+	hello, err := xconn.ReadHello(peer, serializer)
+	if err != nil {
+		return err
+	}
+
+	base, err := xconn.Accept(peer, hello, serializer, s.authenticator)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = base.Close() }()
+
+	_ = conn.SetDeadline(time.Time{})
+	peer.readLimit = rawSocketMaxFrame
+
+	s.onJoin(base.ID(), conn.RemoteAddr())
+	defer s.onLeave(base.ID())
+
+	if err = s.router.AttachClient(base); err != nil {
+		return fmt.Errorf("failed to attach client: %w", err)
+	}
+	defer func() { _ = s.router.DetachClient(base) }()
+
+	for {
+		msg, err := base.ReadMessage()
+		if err != nil {
+			return nil
+		}
+
+		if err = s.router.ReceiveMessage(base, msg); err != nil {
+			return err
+		}
+	}
+}
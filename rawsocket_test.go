@@ -0,0 +1,200 @@
+package wampshell_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/xconnio/wampshell"
+)
+
+func serializerID() byte {
+	return byte(wampshell.CapnprotoSerializerSpec.SerializerID())
+}
+
+// handshake connects a client to a rawsocket peer accepting messages of up to
+// readLimit bytes. The client announces that it accepts messages of up to 512 bytes.
+func handshake(t *testing.T, readLimit int) (net.Conn, *wampshell.RawSocketPeer) {
+	t.Helper()
+
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		_ = server.Close()
+		_ = client.Close()
+	})
+
+	go func() {
+		_, _ = client.Write([]byte{0x7F, serializerID(), 0, 0})
+	}()
+
+	type result struct {
+		peer *wampshell.RawSocketPeer
+		err  error
+	}
+	accepted := make(chan result, 1)
+	go func() {
+		peer, err := wampshell.AcceptRawSocket(server, readLimit)
+		accepted <- result{peer, err}
+	}()
+
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatalf("failed to read handshake reply: %v", err)
+	}
+	if want := []byte{0x7F, 0xF0 | serializerID(), 0, 0}; !bytes.Equal(reply, want) {
+		t.Fatalf("handshake reply %x, want %x", reply, want)
+	}
+
+	r := <-accepted
+	if r.err != nil {
+		t.Fatalf("handshake failed: %v", r.err)
+	}
+
+	return client, r.peer
+}
+
+func frame(frameType byte, payload []byte) []byte {
+	length := len(payload)
+	return append([]byte{frameType, byte(length >> 16), byte(length >> 8), byte(length)}, payload...)
+}
+
+func TestRawSocketUnsupportedSerializer(t *testing.T) {
+	server, client := net.Pipe()
+	defer func() { _ = client.Close() }()
+
+	go func() {
+		_, _ = client.Write([]byte{0x7F, (serializerID() + 1) & 0x0F, 0, 0})
+	}()
+
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := wampshell.AcceptRawSocket(server, 1024)
+		accepted <- err
+		_ = server.Close()
+	}()
+
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatalf("failed to read handshake reply: %v", err)
+	}
+	if want := []byte{0x7F, 0x10, 0, 0}; !bytes.Equal(reply, want) {
+		t.Fatalf("handshake reply %x, want %x", reply, want)
+	}
+	if err := <-accepted; err == nil {
+		t.Fatal("expected the handshake to fail")
+	}
+}
+
+func TestRawSocketNotRawSocket(t *testing.T) {
+	server, client := net.Pipe()
+	defer func() { _ = client.Close() }()
+
+	go func() {
+		_, _ = client.Write([]byte("GET "))
+	}()
+
+	if _, err := wampshell.AcceptRawSocket(server, 1024); err == nil {
+		t.Fatal("expected the handshake to fail")
+	}
+}
+
+func TestRawSocketRead(t *testing.T) {
+	client, peer := handshake(t, 1024)
+
+	go func() {
+		_, _ = client.Write(frame(0, []byte("hello")))
+	}()
+
+	message, err := peer.Read()
+	if err != nil {
+		t.Fatalf("failed to read message: %v", err)
+	}
+	if string(message) != "hello" {
+		t.Fatalf("read %q, want %q", message, "hello")
+	}
+}
+
+func TestRawSocketPing(t *testing.T) {
+	client, peer := handshake(t, 1024)
+
+	read := make(chan []byte, 1)
+	go func() {
+		message, _ := peer.Read()
+		read <- message
+	}()
+
+	if _, err := client.Write(frame(1, []byte("ping"))); err != nil {
+		t.Fatalf("failed to send ping: %v", err)
+	}
+
+	pong := make([]byte, 8)
+	if _, err := io.ReadFull(client, pong); err != nil {
+		t.Fatalf("failed to read pong: %v", err)
+	}
+	if want := frame(2, []byte("ping")); !bytes.Equal(pong, want) {
+		t.Fatalf("pong %x, want %x", pong, want)
+	}
+
+	// pongs are skipped and the ping was not returned as a message
+	if _, err := client.Write(frame(2, nil)); err != nil {
+		t.Fatalf("failed to send pong: %v", err)
+	}
+	if _, err := client.Write(frame(0, []byte("after"))); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+	if message := <-read; string(message) != "after" {
+		t.Fatalf("read %q, want %q", message, "after")
+	}
+}
+
+func TestRawSocketReadLimit(t *testing.T) {
+	client, peer := handshake(t, 1024)
+
+	// only the header is sent, the peer must refuse the frame before reading or
+	// allocating its payload
+	go func() {
+		_, _ = client.Write([]byte{0, 0, 0x04, 0x01})
+	}()
+
+	if _, err := peer.Read(); err == nil {
+		t.Fatal("expected a frame over the limit to be refused")
+	}
+}
+
+func TestRawSocketInvalidFrameType(t *testing.T) {
+	client, peer := handshake(t, 1024)
+
+	go func() {
+		_, _ = client.Write(frame(3, nil))
+	}()
+
+	if _, err := peer.Read(); err == nil {
+		t.Fatal("expected an invalid frame type to be refused")
+	}
+}
+
+func TestRawSocketWrite(t *testing.T) {
+	client, peer := handshake(t, 1024)
+
+	written := make(chan error, 1)
+	go func() {
+		written <- peer.Write([]byte("hello"))
+	}()
+
+	message := make([]byte, 9)
+	if _, err := io.ReadFull(client, message); err != nil {
+		t.Fatalf("failed to read message: %v", err)
+	}
+	if want := frame(0, []byte("hello")); !bytes.Equal(message, want) {
+		t.Fatalf("message %x, want %x", message, want)
+	}
+	if err := <-written; err != nil {
+		t.Fatalf("failed to write message: %v", err)
+	}
+
+	// the client announced that it accepts at most 512 bytes
+	if err := peer.Write(make([]byte, 513)); err == nil {
+		t.Fatal("expected a message over the limit of the client to be refused")
+	}
+}
@@ -0,0 +1,219 @@
+package wampshell
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+
+	"github.com/xconnio/xconn-go"
+)
+
+// relayBuffer is the number of chunks buffered between the download from the source
+// host and the upload to the destination host.
+const relayBuffer = 8
+
+var errRelayAborted = errors.New("upload to destination failed")
+
+// CopyTo copies the file at remotePath to dstPath on the host of dst. The data is
+// streamed through this client, decrypted with the keys of one session and encrypted
+// with those of the other, without being stored locally.
+func (c *FileClient) CopyTo(remotePath string, dst *FileClient, dstPath string, opts *TransferOptions) error {
+	entry, err := c.Stat(remotePath)
+	if err != nil {
+		return err
+	}
+	if entry.Type != FileTypeRegular {
+		return fmt.Errorf("%s is not a regular file", remotePath)
+	}
+
+	return c.copyTo(remotePath, entry, dst, dstPath, opts)
+}
+
+func (c *FileClient) copyTo(remotePath string, entry *FileEntry, dst *FileClient, dstPath string,
+	opts *TransferOptions) error {
+	var offset int64
+	if opts.Resume {
+		var err error
+		if offset, err = dst.resumeOffset(dstPath, entry.Size); err != nil {
+			return err
+		}
+	}
+
+	downloadHeader, err := c.encryptJSON(&TransferRequest{Path: remotePath, Offset: offset})
+	if err != nil {
+		return err
+	}
+
+	upload, err := NewStream(dst.keys.Send)
+	if err != nil {
+		return err
+	}
+	uploadHeader, err := upload.EncryptJSON(&TransferRequest{
+		Path:     dstPath,
+		Offset:   offset,
+		Metadata: opts.metadata(entry.Metadata),
+	})
+	if err != nil {
+		return err
+	}
+
+	progress := opts.progress()
+	progress.Start(&Transfer{
+		Source:      remotePath,
+		Destination: dstPath,
+		Upload:      true,
+		Size:        entry.Size,
+		Offset:      offset,
+	})
+
+	chunks := make(chan []byte, relayBuffer)
+	stop := make(chan struct{})
+	var source TransferResult
+	downloaded := make(chan error, 1)
+	go func() {
+		defer close(chunks)
+
+		var relayErr error
+		callResponse := c.session.Call(procedureFileDownload).Arg(downloadHeader).
+			ProgressReceiver(func(result *xconn.InvocationResult) {
+				if relayErr != nil || len(result.Args) == 0 {
+					return
+				}
+				payload, ok := result.Args[0].([]byte)
+				if !ok {
+					relayErr = fmt.Errorf("invalid chunk from server")
+					return
+				}
+
+				chunk, err := DecryptPayload(payload, c.keys.Receive)
+				if err != nil {
+					relayErr = err
+					return
+				}
+
+				select {
+				case chunks <- chunk:
+				case <-stop:
+					relayErr = errRelayAborted
+				}
+			}).Do()
+		if callResponse.Err != nil {
+			downloaded <- fmt.Errorf("file download error: %w", callResponse.Err)
+			return
+		}
+		if relayErr != nil {
+			downloaded <- relayErr
+			return
+		}
+
+		downloaded <- c.decryptJSON(callResponse, &source)
+	}()
+
+	firstProgress := true
+	var encryptErr, downloadErr error
+	downloadDone := false
+	callResponse := dst.session.Call(procedureFileUpload).
+		ProgressSender(func(ctx context.Context) *xconn.Progress {
+			if firstProgress {
+				firstProgress = false
+				return xconn.NewProgress(uploadHeader)
+			}
+
+			chunk, ok := <-chunks
+			if !ok {
+				// the download has finished once chunks is closed, only a complete
+				// source file may complete the upload
+				downloadErr, downloadDone = <-downloaded, true
+				if downloadErr != nil {
+					return upload.Abort()
+				}
+				return upload.Final()
+			}
+
+			payload, err := upload.Encrypt(chunk)
+			if err != nil {
+				encryptErr = err
+				return upload.Abort()
+			}
+			progress.Add(len(chunk))
+			return xconn.NewProgress(payload)
+		}).Do()
+	close(stop)
+
+	if !downloadDone {
+		downloadErr = <-downloaded
+	}
+	// a failed download aborts the upload, its error is the one worth reporting
+	if downloadErr != nil && !errors.Is(downloadErr, errRelayAborted) {
+		return downloadErr
+	}
+	if encryptErr != nil {
+		return encryptErr
+	}
+	if callResponse.Err != nil {
+		return fmt.Errorf("file upload error: %w", callResponse.Err)
+	}
+
+	var destination TransferResult
+	if err = dst.decryptJSON(callResponse, &destination); err != nil {
+		return err
+	}
+	if destination.Size != source.Size {
+		return fmt.Errorf("size mismatch: source file has %d bytes, destination file has %d bytes",
+			source.Size, destination.Size)
+	}
+	if destination.SHA256 != source.SHA256 {
+		return fmt.Errorf("checksum mismatch: source file has SHA-256 %s, destination file has %s",
+			source.SHA256, destination.SHA256)
+	}
+
+	progress.Finish()
+	return nil
+}
+
+// CopyTreeTo copies the tree rooted at remoteRoot to dstRoot on the host of dst, see
+// CopyTo and UploadTree.
+func (c *FileClient) CopyTreeTo(remoteRoot string, dst *FileClient, dstRoot string, opts *TransferOptions) error {
+	entries, err := c.Walk(remoteRoot)
+	if err != nil {
+		return err
+	}
+
+	var dirs []*FSRequest
+	for i := range entries {
+		entry := &entries[i]
+		if !filepath.IsLocal(filepath.FromSlash(entry.Path)) {
+			return fmt.Errorf("invalid path from server: %s", entry.Path)
+		}
+		dstPath := path.Join(dstRoot, entry.Path)
+
+		switch entry.Type {
+		case FileTypeDir:
+			if err = dst.Mkdir(dstPath, 0, true); err != nil {
+				return err
+			}
+			if metadata := opts.metadata(entry.Metadata); metadata != nil {
+				dirs = append(dirs, &FSRequest{Path: dstPath, Recursive: true, Metadata: metadata})
+			}
+		case FileTypeSymlink:
+			err = dst.Symlink(dstPath, entry.Target)
+		case FileTypeRegular:
+			err = c.copyTo(path.Join(remoteRoot, entry.Path), entry, dst, dstPath, opts)
+		default:
+			return fmt.Errorf("unsupported file type %q for %s", entry.Type, entry.Path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err = dst.call(procedureFSMkdir, dirs[i], nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
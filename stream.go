@@ -0,0 +1,95 @@
+package wampshell
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+
+	"github.com/xconnio/xconn-go"
+)
+
+// streamAbort is the body of a final message that aborts a stream.
+const streamAbort = "abort"
+
+// NewStreamMessage prefixes body with the id of the stream it belongs to. wshd keeps
+// the state of a shell, command, upload or sync patch across the progressive
+// messages of its call, and a session may have several of them open at the same
+// time, e.g. when it is shared by a master connection. Forwarded connections use
+// the same framing with the id of the connection.
+func NewStreamMessage(id uint64, body []byte) []byte {
+	message := make([]byte, 8+len(body))
+	binary.BigEndian.PutUint64(message[:8], id)
+	copy(message[8:], body)
+	return message
+}
+
+// ParseStreamMessage splits a message of NewStreamMessage into the stream id and
+// the body.
+func ParseStreamMessage(message []byte) (id uint64, body []byte, err error) {
+	if len(message) < 8 {
+		return 0, nil, fmt.Errorf("invalid stream message")
+	}
+
+	return binary.BigEndian.Uint64(message[:8]), message[8:], nil
+}
+
+// Stream is the sending side of a progressive call whose messages carry a stream
+// id. The final message carries no body, a final message with a body aborts the
+// stream instead: wshd kills the command or discards the file.
+type Stream struct {
+	id      uint64
+	sendKey []byte
+}
+
+// NewStream picks a random id for a new stream, clients that share a session do not
+// know about each other's streams. Zero is never picked, wshd uses it for shells of
+// clients that predate streams.
+func NewStream(sendKey []byte) (*Stream, error) {
+	var id [8]byte
+	for {
+		if _, err := rand.Read(id[:]); err != nil {
+			return nil, fmt.Errorf("failed to create stream id: %w", err)
+		}
+		if binary.BigEndian.Uint64(id[:]) != 0 {
+			break
+		}
+	}
+
+	return &Stream{id: binary.BigEndian.Uint64(id[:]), sendKey: sendKey}, nil
+}
+
+// Encrypt returns the encrypted message of the stream that carries body.
+func (s *Stream) Encrypt(body []byte) ([]byte, error) {
+	return EncryptPayload(NewStreamMessage(s.id, body), s.sendKey)
+}
+
+// EncryptJSON returns the encrypted message of the stream that carries v as JSON.
+func (s *Stream) EncryptJSON(v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.Encrypt(data)
+}
+
+// Final returns the final message of the stream.
+func (s *Stream) Final() *xconn.Progress {
+	return s.final(nil)
+}
+
+// Abort returns a final message that aborts the stream.
+func (s *Stream) Abort() *xconn.Progress {
+	return s.final([]byte(streamAbort))
+}
+
+func (s *Stream) final(body []byte) *xconn.Progress {
+	payload, err := s.Encrypt(body)
+	if err != nil {
+		// wshd can not tell which stream such a message ends, it fails the call
+		return xconn.NewFinalProgress()
+	}
+
+	return xconn.NewFinalProgress(payload)
+}
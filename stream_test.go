@@ -0,0 +1,60 @@
+package wampshell_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/xconnio/wampshell"
+)
+
+func TestStreamMessage(t *testing.T) {
+	for _, body := range [][]byte{nil, []byte("hello")} {
+		id, got, err := wampshell.ParseStreamMessage(wampshell.NewStreamMessage(42, body))
+		if err != nil {
+			t.Fatalf("ParseStreamMessage(%q): %v", body, err)
+		}
+		if id != 42 || !bytes.Equal(got, body) {
+			t.Errorf("ParseStreamMessage(%q) = %d, %q", body, id, got)
+		}
+	}
+
+	if _, _, err := wampshell.ParseStreamMessage([]byte{1, 2, 3}); err == nil {
+		t.Error("ParseStreamMessage accepted a message without a stream id")
+	}
+}
+
+func TestStreamEncrypt(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+
+	ids := make(map[uint64]bool)
+	for range 16 {
+		stream, err := wampshell.NewStream(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		payload, err := stream.Encrypt([]byte("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		message, err := wampshell.DecryptPayload(payload, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, body, err := wampshell.ParseStreamMessage(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if id == 0 {
+			t.Error("stream id 0 is reserved for shells of clients that predate streams")
+		}
+		if ids[id] {
+			t.Errorf("stream id %d picked twice", id)
+		}
+		ids[id] = true
+		if string(body) != "data" {
+			t.Errorf("body = %q, want %q", body, "data")
+		}
+	}
+}
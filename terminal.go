@@ -0,0 +1,112 @@
+package wampshell
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+const (
+	MessageData      byte = 0x00
+	MessageResize    byte = 0x01
+	MessageResume    byte = 0x02
+	MessageSession   byte = 0x03
+	MessageKeepalive byte = 0x04
+)
+
+// ErrorShellDetached is returned to a caller whose shell was detached because its
+// keepalives stopped, the shell can be resumed with a new call.
+const ErrorShellDetached = "wampshell.error.shell_detached"
+
+const (
+	// ShellTokenSize is the length of the token that resumes a shell.
+	ShellTokenSize = 16
+	// ShellKeepaliveInterval is how often both sides of a resumable shell show that
+	// the connection is alive.
+	ShellKeepaliveInterval = 5 * time.Second
+	// ShellKeepaliveTimeout is how long a side waits for a keepalive before it
+	// considers the connection lost.
+	ShellKeepaliveTimeout = 3 * ShellKeepaliveInterval
+	// ShellGracePeriod is how long wshd keeps a shell whose connection was lost.
+	ShellGracePeriod = 10 * time.Minute
+)
+
+func NewDataMessage(data []byte) []byte {
+	message := make([]byte, 1+len(data))
+	message[0] = MessageData
+	copy(message[1:], data)
+	return message
+}
+
+func NewResizeMessage(rows, cols uint16) []byte {
+	message := make([]byte, 5)
+	message[0] = MessageResize
+	binary.BigEndian.PutUint16(message[1:3], rows)
+	binary.BigEndian.PutUint16(message[3:5], cols)
+	return message
+}
+
+func ParseResizeMessage(message []byte) (rows, cols uint16, err error) {
+	if len(message) != 5 || message[0] != MessageResize {
+		return 0, 0, fmt.Errorf("invalid resize message")
+	}
+
+	rows = binary.BigEndian.Uint16(message[1:3])
+	cols = binary.BigEndian.Uint16(message[3:5])
+	return rows, cols, nil
+}
+
+// NewResumeMessage opens a resumable shell. A zero token starts a new shell of the
+// given size and terminal type, otherwise the shell with that token is attached
+// again and its output is replayed from offset, the number of output bytes the
+// client has received.
+func NewResumeMessage(token []byte, offset uint64, rows, cols uint16, term string) []byte {
+	message := make([]byte, 1+ShellTokenSize+12, 1+ShellTokenSize+12+len(term))
+	message[0] = MessageResume
+	copy(message[1:1+ShellTokenSize], token)
+	binary.BigEndian.PutUint64(message[1+ShellTokenSize:], offset)
+	binary.BigEndian.PutUint16(message[9+ShellTokenSize:], rows)
+	binary.BigEndian.PutUint16(message[11+ShellTokenSize:], cols)
+	return append(message, term...)
+}
+
+// ParseResumeMessage parses a resume message, the terminal type is empty for
+// clients that do not send one.
+func ParseResumeMessage(message []byte) (token []byte, offset uint64, rows, cols uint16, term string,
+	err error) {
+	if len(message) < 1+ShellTokenSize+12 || message[0] != MessageResume {
+		return nil, 0, 0, 0, "", fmt.Errorf("invalid resume message")
+	}
+
+	token = message[1 : 1+ShellTokenSize]
+	offset = binary.BigEndian.Uint64(message[1+ShellTokenSize:])
+	rows = binary.BigEndian.Uint16(message[9+ShellTokenSize:])
+	cols = binary.BigEndian.Uint16(message[11+ShellTokenSize:])
+	return token, offset, rows, cols, string(message[13+ShellTokenSize:]), nil
+}
+
+// NewSessionMessage is the first output of a resumable shell. It carries the token
+// to resume it with and the offset of the output that follows, which is later than
+// requested if the missed output no longer fits the replay buffer.
+func NewSessionMessage(token []byte, offset uint64) []byte {
+	message := make([]byte, 1+ShellTokenSize+8)
+	message[0] = MessageSession
+	copy(message[1:1+ShellTokenSize], token)
+	binary.BigEndian.PutUint64(message[1+ShellTokenSize:], offset)
+	return message
+}
+
+func ParseSessionMessage(message []byte) (token []byte, offset uint64, err error) {
+	if len(message) != 1+ShellTokenSize+8 || message[0] != MessageSession {
+		return nil, 0, fmt.Errorf("invalid session message")
+	}
+
+	return message[1 : 1+ShellTokenSize], binary.BigEndian.Uint64(message[1+ShellTokenSize:]), nil
+}
+
+// NewKeepaliveMessage is sent by the client of a resumable shell at
+// ShellKeepaliveInterval, wshd answers each with one of its own. Either side
+// considers the connection lost after missing several of them.
+func NewKeepaliveMessage() []byte {
+	return []byte{MessageKeepalive}
+}
@@ -0,0 +1,95 @@
+package wampshell
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"time"
+)
+
+// TransferChunkSize is the amount of file data carried by each encrypted progressive
+// message of an upload or download.
+const TransferChunkSize = 256 * 1024
+
+// TransferRequest starts an upload or download. A non-zero Offset resumes a partial
+// transfer, only the data after it is sent. Metadata is only sent with uploads and is
+// applied to the remote file once it is complete.
+type TransferRequest struct {
+	Path     string        `json:"path"`
+	Offset   int64         `json:"offset,omitempty"`
+	Metadata *FileMetadata `json:"metadata,omitempty"`
+}
+
+// TransferResult completes a transfer. Size and SHA256 cover the whole file, including
+// the part before the offset of a resumed transfer. Downloads report the metadata of
+// the remote file so that the client can apply it locally.
+type TransferResult struct {
+	Size     int64         `json:"size"`
+	SHA256   string        `json:"sha256"`
+	Metadata *FileMetadata `json:"metadata,omitempty"`
+}
+
+// HashPrefix reads the first offset bytes of reader into a new SHA-256, so that a
+// resumed transfer can hash the remaining data into it as it is transferred.
+func HashPrefix(reader io.Reader, offset int64) (hash.Hash, error) {
+	hasher := sha256.New()
+	if _, err := io.CopyN(hasher, reader, offset); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("offset %d is beyond the end of the file", offset)
+		}
+		return nil, err
+	}
+
+	return hasher, nil
+}
+
+// FileMetadata are the file attributes preserved by wcp -p. Ownership is optional
+// because it can only be changed by a privileged user.
+type FileMetadata struct {
+	Mode       os.FileMode `json:"mode"`
+	ModTime    time.Time   `json:"mtime"`
+	AccessTime time.Time   `json:"atime"`
+	UID        *uint32     `json:"uid,omitempty"`
+	GID        *uint32     `json:"gid,omitempty"`
+}
+
+func NewFileMetadata(info os.FileInfo) *FileMetadata {
+	metadata := &FileMetadata{
+		Mode:       info.Mode().Perm(),
+		ModTime:    info.ModTime(),
+		AccessTime: info.ModTime(),
+	}
+	fillFileMetadata(metadata, info)
+
+	return metadata
+}
+
+// Apply sets the metadata on the file at path. Like cp -p, a missing permission to
+// change the ownership is not treated as an error.
+func (m *FileMetadata) Apply(path string) error {
+	if m.UID != nil || m.GID != nil {
+		uid, gid := -1, -1
+		if m.UID != nil {
+			uid = int(*m.UID)
+		}
+		if m.GID != nil {
+			gid = int(*m.GID)
+		}
+		if err := os.Chown(path, uid, gid); err != nil && !errors.Is(err, os.ErrPermission) {
+			return fmt.Errorf("failed to change ownership of %s: %w", path, err)
+		}
+	}
+
+	if err := os.Chmod(path, m.Mode.Perm()); err != nil {
+		return fmt.Errorf("failed to change mode of %s: %w", path, err)
+	}
+
+	if err := os.Chtimes(path, m.AccessTime, m.ModTime); err != nil {
+		return fmt.Errorf("failed to change times of %s: %w", path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,18 @@
+package wampshell
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+func fillFileMetadata(metadata *FileMetadata, info os.FileInfo) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+
+	metadata.AccessTime = time.Unix(stat.Atim.Unix())
+	metadata.UID = &stat.Uid
+	metadata.GID = &stat.Gid
+}
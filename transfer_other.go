@@ -0,0 +1,20 @@
+//go:build !linux
+
+package wampshell
+
+import (
+	"os"
+	"syscall"
+)
+
+// fillFileMetadata adds the ownership of the file, the layout of the access time
+// in syscall.Stat_t differs between platforms so the modification time is kept.
+func fillFileMetadata(metadata *FileMetadata, info os.FileInfo) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+
+	metadata.UID = &stat.Uid
+	metadata.GID = &stat.Gid
+}